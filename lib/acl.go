@@ -0,0 +1,205 @@
+package bucketsync
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
+)
+
+// POSIX ACLs are stored as xattrs in the format of Linux, so getfacl and
+// setfacl work as they are. Base entries of the access ACL are kept in
+// sync with mode bits, and a minimal ACL is stored only as mode bits.
+// New nodes inherit the default ACL of the directory.
+const (
+	aclAccessName  = "system.posix_acl_access"
+	aclDefaultName = "system.posix_acl_default"
+)
+
+// Format: version(4) | entries, entry is tag(2) | perm(2) | id(4)
+const (
+	aclVersion   = 2
+	aclEntrySize = 8
+)
+
+// ACL entry tags
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+const aclUndefinedID = 0xffffffff
+
+var ErrInvalidACL = errors.New("invalid ACL")
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+type acl []aclEntry
+
+func parseACL(data []byte) (acl, error) {
+	if len(data) < 4 || (len(data)-4)%aclEntrySize != 0 {
+		return nil, errors.Wrapf(ErrInvalidACL, "size = %d", len(data))
+	}
+	if version := binary.LittleEndian.Uint32(data); version != aclVersion {
+		return nil, errors.Wrapf(ErrInvalidACL, "version = %d", version)
+	}
+
+	a := make(acl, 0, (len(data)-4)/aclEntrySize)
+	count := make(map[uint16]int)
+	ids := make(map[uint64]bool)
+	for off := 4; off < len(data); off += aclEntrySize {
+		e := aclEntry{
+			tag:  binary.LittleEndian.Uint16(data[off:]),
+			perm: binary.LittleEndian.Uint16(data[off+2:]),
+			id:   binary.LittleEndian.Uint32(data[off+4:]),
+		}
+		if e.perm&^7 != 0 {
+			return nil, errors.Wrapf(ErrInvalidACL, "perm = %o", e.perm)
+		}
+		switch e.tag {
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+			e.id = aclUndefinedID
+		case aclUser, aclGroup:
+			id := uint64(e.tag)<<32 | uint64(e.id)
+			if ids[id] {
+				return nil, errors.Wrapf(ErrInvalidACL, "duplicated id = %d", e.id)
+			}
+			ids[id] = true
+		default:
+			return nil, errors.Wrapf(ErrInvalidACL, "tag = %x", e.tag)
+		}
+		count[e.tag]++
+		a = append(a, e)
+	}
+
+	if count[aclUserObj] != 1 || count[aclGroupObj] != 1 || count[aclOther] != 1 || count[aclMask] > 1 {
+		return nil, errors.Wrap(ErrInvalidACL, "base entries are invalid")
+	}
+	if count[aclMask] == 0 && count[aclUser]+count[aclGroup] > 0 {
+		return nil, errors.Wrap(ErrInvalidACL, "mask is required")
+	}
+	return a, nil
+}
+
+func (a acl) bytes() []byte {
+	data := make([]byte, 4+len(a)*aclEntrySize)
+	binary.LittleEndian.PutUint32(data, aclVersion)
+	for i, e := range a {
+		off := 4 + i*aclEntrySize
+		binary.LittleEndian.PutUint16(data[off:], e.tag)
+		binary.LittleEndian.PutUint16(data[off+2:], e.perm)
+		binary.LittleEndian.PutUint32(data[off+4:], e.id)
+	}
+	return data
+}
+
+func (a acl) find(tag uint16) *aclEntry {
+	for i := range a {
+		if a[i].tag == tag {
+			return &a[i]
+		}
+	}
+	return nil
+}
+
+// minimal returns true if the ACL is the same as mode bits
+func (a acl) minimal() bool {
+	return len(a) == 3
+}
+
+// groupClass is the entry which is mapped to group bits of mode
+func (a acl) groupClass() *aclEntry {
+	if mask := a.find(aclMask); mask != nil {
+		return mask
+	}
+	return a.find(aclGroupObj)
+}
+
+// mode returns permission bits of mode
+func (a acl) mode() uint32 {
+	return uint32(a.find(aclUserObj).perm)<<6 |
+		uint32(a.groupClass().perm)<<3 |
+		uint32(a.find(aclOther).perm)
+}
+
+// setMode updates base entries by permission bits of mode
+func (a acl) setMode(mode uint32) {
+	a.find(aclUserObj).perm = uint16(mode>>6) & 7
+	a.groupClass().perm = uint16(mode>>3) & 7
+	a.find(aclOther).perm = uint16(mode) & 7
+}
+
+// acl returns the stored ACL, or nil
+func (m Meta) acl(name string) acl {
+	x, ok := m.XAttrs[name]
+	if !ok {
+		return nil
+	}
+	a, err := parseACL(x.Value)
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+// setACL sets ACL xattr by setxattr(2), the access ACL changes mode.
+func (m *Meta) setACL(name string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if context.Uid != 0 && context.Uid != m.UID {
+		return fuse.EPERM
+	}
+	if name == aclDefaultName && m.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return fuse.EACCES
+	}
+	a, err := parseACL(data)
+	if err != nil {
+		return fuse.EINVAL
+	}
+
+	if name == aclAccessName {
+		m.Mode = (m.Mode &^ 0777) | a.mode()
+		if a.minimal() {
+			delete(m.XAttrs, name)
+			return fuse.OK
+		}
+	}
+	return m.setXAttr(name, &XAttr{Value: a.bytes()}, flags)
+}
+
+// syncACL updates the access ACL after chmod
+func (m *Meta) syncACL() {
+	a := m.acl(aclAccessName)
+	if a == nil {
+		return
+	}
+	a.setMode(m.Mode)
+	m.XAttrs[aclAccessName] = &XAttr{Value: a.bytes()}
+}
+
+// inheritACL sets ACLs of a node created in parent. The access ACL is the
+// default ACL of parent masked by mode, and directory inherits the
+// default ACL too.
+func (m *Meta) inheritACL(parent Meta) {
+	def := parent.acl(aclDefaultName)
+	if def == nil {
+		return
+	}
+	if m.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		m.setXAttr(aclDefaultName, &XAttr{Value: def.bytes()}, 0)
+	}
+
+	access := append(acl{}, def...)
+	access.setMode(access.mode() & m.Mode)
+	m.Mode = (m.Mode &^ 0777) | access.mode()
+	if !access.minimal() {
+		m.setXAttr(aclAccessName, &XAttr{Value: access.bytes()}, 0)
+	}
+}
@@ -0,0 +1,93 @@
+package bucketsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// encodeACL returns xattr value of entries, in the format of Linux
+func encodeACL(version uint32, entries ...aclEntry) []byte {
+	data := make([]byte, 4+len(entries)*aclEntrySize)
+	binary.LittleEndian.PutUint32(data, version)
+	for i, e := range entries {
+		off := 4 + i*aclEntrySize
+		binary.LittleEndian.PutUint16(data[off:], e.tag)
+		binary.LittleEndian.PutUint16(data[off+2:], e.perm)
+		binary.LittleEndian.PutUint32(data[off+4:], e.id)
+	}
+	return data
+}
+
+var (
+	userObj  = aclEntry{tag: aclUserObj, perm: 6, id: aclUndefinedID}
+	groupObj = aclEntry{tag: aclGroupObj, perm: 4, id: aclUndefinedID}
+	other    = aclEntry{tag: aclOther, perm: 0, id: aclUndefinedID}
+	mask     = aclEntry{tag: aclMask, perm: 5, id: aclUndefinedID}
+)
+
+func TestParseACL(t *testing.T) {
+	user := aclEntry{tag: aclUser, perm: 7, id: 1000}
+	group := aclEntry{tag: aclGroup, perm: 2, id: 100}
+
+	valid := map[string][]byte{
+		"minimal":  encodeACL(aclVersion, userObj, groupObj, other),
+		"extended": encodeACL(aclVersion, userObj, user, groupObj, group, mask, other),
+		"mask":     encodeACL(aclVersion, userObj, groupObj, mask, other),
+	}
+	for name, data := range valid {
+		a, err := parseACL(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(a.bytes(), data) {
+			t.Fatalf("%s: encoded differently", name)
+		}
+	}
+
+	invalid := map[string][]byte{
+		"empty":          {},
+		"short":          encodeACL(aclVersion, userObj, groupObj, other)[:20],
+		"version":        encodeACL(1, userObj, groupObj, other),
+		"no other":       encodeACL(aclVersion, userObj, groupObj),
+		"two owners":     encodeACL(aclVersion, userObj, userObj, groupObj, other),
+		"no mask":        encodeACL(aclVersion, userObj, user, groupObj, other),
+		"duplicated id":  encodeACL(aclVersion, userObj, user, user, groupObj, mask, other),
+		"unknown tag":    encodeACL(aclVersion, userObj, groupObj, other, aclEntry{tag: 0x40}),
+		"invalid perm":   encodeACL(aclVersion, aclEntry{tag: aclUserObj, perm: 8}, groupObj, other),
+		"two masks":      encodeACL(aclVersion, userObj, groupObj, mask, mask, other),
+		"trailing bytes": append(encodeACL(aclVersion, userObj, groupObj, other), 0),
+	}
+	for name, data := range invalid {
+		if _, err := parseACL(data); errors.Cause(err) != ErrInvalidACL {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	// Same user id can be both user and group
+	same := encodeACL(aclVersion, userObj, aclEntry{tag: aclUser, perm: 1, id: 5},
+		groupObj, aclEntry{tag: aclGroup, perm: 1, id: 5}, mask, other)
+	if _, err := parseACL(same); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestACLMode(t *testing.T) {
+	minimal, _ := parseACL(encodeACL(aclVersion, userObj, groupObj, other))
+	if !minimal.minimal() || minimal.mode() != 0640 {
+		t.Fatalf("minimal = %v, mode = %o", minimal.minimal(), minimal.mode())
+	}
+
+	// Group bits are mapped to the mask, if there is
+	extended, _ := parseACL(encodeACL(aclVersion, userObj, groupObj, mask, other))
+	if extended.minimal() || extended.mode() != 0650 {
+		t.Fatalf("minimal = %v, mode = %o", extended.minimal(), extended.mode())
+	}
+	extended.setMode(0751)
+	if extended.find(aclMask).perm != 5 || extended.find(aclGroupObj).perm != 4 ||
+		extended.find(aclUserObj).perm != 7 || extended.find(aclOther).perm != 1 {
+		t.Fatalf("setMode: %v", extended)
+	}
+}
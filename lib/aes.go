@@ -3,6 +3,7 @@ package bucketsync
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"io"
 
@@ -11,33 +12,146 @@ import (
 
 type Cipher struct {
 	block cipher.Block
+	aead  cipher.AEAD
 }
 
-func NewCipher(password string) (*Cipher, error) {
-	key := sha256.Sum256([]byte(password))
-	block, err := aes.NewCipher(key[:])
+// NewCipher returns AES-256 cipher, key is derived from password
+// by BucketHeader.
+func NewCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
 	}
 	return &Cipher{
 		block: block,
+		aead:  aead,
 	}, nil
 }
 
-func (c *Cipher) StreamReader(in io.Reader, key ObjectKey) (cipher.StreamReader, error) {
-	if len(key) < aes.BlockSize {
-		return cipher.StreamReader{}, errors.New("key length is too short")
+// Seal encrypts plaintext with AES-GCM and a random nonce.
+// header and ObjectKey are authenticated, so an object can't be
+// swapped with another one.
+// Output is nonce | ciphertext | tag
+func (c *Cipher) Seal(header []byte, key ObjectKey, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
 	}
-	iv := []byte(key)[:aes.BlockSize]
-	stream := cipher.NewCTR(c.block, iv)
-	return cipher.StreamReader{S: stream, R: in}, nil
+	return c.aead.Seal(nonce, nonce, plaintext, c.additionalData(header, key)), nil
 }
 
-func (c *Cipher) StreamWriter(out io.Writer, key ObjectKey) (cipher.StreamWriter, error) {
-	if len(key) < aes.BlockSize {
-		return cipher.StreamWriter{}, errors.New("key length is too short")
+// Open decrypts the output of Seal, ErrCorruptObject is returned if
+// authentication failed.
+func (c *Cipher) Open(header []byte, key ObjectKey, sealed []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize()+c.aead.Overhead() {
+		return nil, ErrCorruptObject
+	}
+	nonce := sealed[:c.aead.NonceSize()]
+	plaintext, err := c.aead.Open(nil, nonce, sealed[c.aead.NonceSize():], c.additionalData(header, key))
+	if err != nil {
+		return nil, errors.Wrap(ErrCorruptObject, err.Error())
 	}
-	iv := []byte(key)[:aes.BlockSize]
-	stream := cipher.NewCTR(c.block, iv)
-	return cipher.StreamWriter{S: stream, W: out}, nil
+	return plaintext, nil
+}
+
+// SealSegments encrypts plaintext in segments of segmentSize, so a part of
+// the object can be decrypted without the rest.
+// Output is nonce | sealed segment | sealed segment ...
+// Nonce of a segment is the nonce XOR segment index, and the last segment
+// is marked in additional data, to detect reordering and truncation.
+func (c *Cipher) SealSegments(header []byte, key ObjectKey, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	count := (len(plaintext) + segmentSize - 1) / segmentSize
+	out := make([]byte, 0, len(nonce)+len(plaintext)+count*c.aead.Overhead())
+	out = append(out, nonce...)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * segmentSize
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		out = c.aead.Seal(out, c.segmentNonce(nonce, i), plaintext[i*segmentSize:end],
+			c.segmentAdditionalData(header, key, i == count-1))
+	}
+	return out, nil
+}
+
+// OpenSegments decrypts whole output of SealSegments
+func (c *Cipher) OpenSegments(header []byte, key ObjectKey, sealed []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, ErrCorruptObject
+	}
+	nonce := sealed[:c.aead.NonceSize()]
+	plaintext, _, err := c.openSegments(header, key, nonce, 0, sealed[c.aead.NonceSize():], true)
+	return plaintext, err
+}
+
+// openSegments decrypts segments from index first. If last is true, the
+// last segment must be the final segment of the object.
+// It returns true if the final segment is included.
+func (c *Cipher) openSegments(header []byte, key ObjectKey, nonce []byte, first int, sealed []byte, last bool) ([]byte, bool, error) {
+	sealedSize := segmentSize + c.aead.Overhead()
+	plaintext := make([]byte, 0, len(sealed))
+	for i := 0; len(sealed) > 0; i++ {
+		n := sealedSize
+		if n > len(sealed) {
+			n = len(sealed)
+		}
+		final := n == len(sealed) && (last || n < sealedSize)
+		out, err := c.aead.Open(plaintext, c.segmentNonce(nonce, first+i), sealed[:n],
+			c.segmentAdditionalData(header, key, final))
+		if err != nil && n == len(sealed) && !final {
+			// Full size segment at the end of range can be the final one
+			final = true
+			out, err = c.aead.Open(plaintext, c.segmentNonce(nonce, first+i), sealed[:n],
+				c.segmentAdditionalData(header, key, final))
+		}
+		if err != nil {
+			return nil, false, errors.Wrap(ErrCorruptObject, err.Error())
+		}
+		plaintext = out
+		sealed = sealed[n:]
+		if len(sealed) == 0 {
+			return plaintext, final, nil
+		}
+	}
+	return plaintext, false, nil
+}
+
+func (c *Cipher) segmentNonce(nonce []byte, index int) []byte {
+	out := append([]byte{}, nonce...)
+	for i := 0; i < 8; i++ {
+		out[len(out)-1-i] ^= byte(uint64(index) >> (8 * uint(i)))
+	}
+	return out
+}
+
+func (c *Cipher) segmentAdditionalData(header []byte, key ObjectKey, final bool) []byte {
+	ad := c.additionalData(header, key)
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+func (c *Cipher) additionalData(header []byte, key ObjectKey) []byte {
+	ad := make([]byte, 0, len(header)+len(key))
+	ad = append(ad, header...)
+	return append(ad, key...)
+}
+
+// StreamReader decrypts legacy AES-CTR object,
+// IV is derived from ObjectKey.
+func (c *Cipher) StreamReader(in io.Reader, key ObjectKey) cipher.StreamReader {
+	sum := sha256.Sum256([]byte(key))
+	stream := cipher.NewCTR(c.block, sum[:aes.BlockSize])
+	return cipher.StreamReader{S: stream, R: in}
 }
@@ -2,33 +2,45 @@ package bucketsync
 
 import (
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 type cache struct {
-	hash           map[ObjectKey]*keyValue
-	lock           sync.RWMutex
-	listHead       *keyValue
-	currentEntries int
-	maxEntries     int
+	hash         map[ObjectKey]*keyValue
+	lock         sync.Mutex
+	listHead     *keyValue
+	currentBytes int64
+	maxBytes     int64
+	stats        CacheStats
 }
 
 type keyValue struct {
 	key   ObjectKey
 	value []byte
+	added time.Time
 	prev  *keyValue
 	next  *keyValue
 }
 
-// NewCache returns LRU Cache
-func NewCache(maxEntries int) *cache {
+// CacheStats is counters of cache
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+// NewCache returns LRU Cache, bounded by total size of values
+func NewCache(maxBytes int64) *cache {
 	c := &cache{
-		hash:           make(map[ObjectKey]*keyValue),
-		currentEntries: 0,
-		maxEntries:     maxEntries,
-		listHead:       &keyValue{},
-		lock:           sync.RWMutex{},
+		hash:         make(map[ObjectKey]*keyValue),
+		currentBytes: 0,
+		maxBytes:     maxBytes,
+		listHead:     &keyValue{},
+		lock:         sync.Mutex{},
 	}
 
 	c.listHead.next = c.listHead
@@ -38,48 +50,56 @@ func NewCache(maxEntries int) *cache {
 
 // Get value from cache if exist
 func (c *cache) Get(key ObjectKey) (data []byte, err error) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if kv, ok := c.hash[key]; ok {
 		if kv != c.listHead.next {
 			listRemove(kv)
 			listAdd(c.listHead, kv)
 
 		}
+		c.stats.Hits++
 		return kv.value, nil
 
 	}
+	c.stats.Misses++
 	return nil, errors.New("not found")
 }
 
-// Add value to cache
+// GetFresh is Get, the value added before maxAge is removed.
+func (c *cache) GetFresh(key ObjectKey, maxAge time.Duration) (data []byte, err error) {
+	c.lock.Lock()
+	if kv, ok := c.hash[key]; ok && time.Since(kv.added) >= maxAge {
+		c.remove(kv)
+	}
+	c.lock.Unlock()
+	return c.Get(key)
+}
+
+// Add value to cache, value larger than the cache is not added.
 func (c *cache) Add(key ObjectKey, data []byte) (err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	if kv, ok := c.hash[key]; ok {
-		if kv != c.listHead.next {
-			listRemove(kv)
-			listAdd(c.listHead, kv)
-		}
-		kv.value = data
-
-	} else {
-		if c.maxEntries != c.currentEntries {
-			c.currentEntries++
+		c.remove(kv)
+	}
+	if int64(len(data)) > c.maxBytes {
+		return nil
+	}
 
-		} else {
-			lastItem := c.listHead.prev
-			delete(c.hash, lastItem.key)
-			listRemove(lastItem)
-		}
+	for c.currentBytes+int64(len(data)) > c.maxBytes {
+		c.remove(c.listHead.prev)
+		c.stats.Evictions++
+	}
 
-		kv := &keyValue{
-			key:   key,
-			value: data,
-		}
-		listAdd(c.listHead, kv)
-		c.hash[key] = kv
+	kv := &keyValue{
+		key:   key,
+		value: data,
+		added: time.Now(),
 	}
+	listAdd(c.listHead, kv)
+	c.hash[key] = kv
+	c.currentBytes += int64(len(data))
 	return nil
 }
 
@@ -88,13 +108,27 @@ func (c *cache) Remove(key ObjectKey) (err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	if kv, ok := c.hash[key]; ok {
-		delete(c.hash, key)
-		listRemove(kv)
-
+		c.remove(kv)
 	}
 	return nil
 }
 
+// Stats returns snapshot of counters
+func (c *cache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.hash)
+	stats.Bytes = c.currentBytes
+	return stats
+}
+
+func (c *cache) remove(kv *keyValue) {
+	delete(c.hash, kv.key)
+	listRemove(kv)
+	c.currentBytes -= int64(len(kv.value))
+}
+
 func listRemove(kv *keyValue) {
 	kv.prev.next = kv.next
 	kv.next.prev = kv.prev
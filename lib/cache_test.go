@@ -0,0 +1,41 @@
+package bucketsync
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCacheBytes(t *testing.T) {
+	c := NewCache(10)
+	c.Add("a", []byte("aaaa"))
+	c.Add("b", []byte("bbbb"))
+	if _, err := c.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	// b is least recently used
+	c.Add("c", []byte("cccc"))
+	if _, err := c.Get("b"); err == nil {
+		t.Fatal("least recently used value is not evicted")
+	}
+	for _, key := range []ObjectKey{"a", "c"} {
+		if data, err := c.Get(key); err != nil || !bytes.Equal(data, bytes.Repeat([]byte(key), 4)) {
+			t.Fatalf("%s = %q, %v", key, data, err)
+		}
+	}
+
+	// Replaced value is counted once, larger value than the cache is not added
+	c.Add("a", []byte("aa"))
+	c.Add("big", make([]byte, 11))
+	stats := c.Stats()
+	if stats.Bytes != 6 || stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("%+v", stats)
+	}
+	if stats.Hits != 3 || stats.Misses != 1 {
+		t.Fatalf("hits = %d, misses = %d", stats.Hits, stats.Misses)
+	}
+
+	c.Remove("a")
+	if stats := c.Stats(); stats.Bytes != 4 || stats.Entries != 1 {
+		t.Fatalf("%+v after remove", stats)
+	}
+}
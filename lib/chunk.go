@@ -0,0 +1,272 @@
+package bucketsync
+
+import (
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Chunks of a file in ChunkingCDC mode are ordered by Offset and cover
+// the file contiguously. Chunk boundaries are decided by content on Save,
+// so inserted bytes only change the chunks around them.
+// A chunk without Key and body is a hole, which is read as zero.
+
+func (e *Extent) isHole() bool {
+	return e.Key == "" && !e.dirty && len(e.body) == 0
+}
+
+func (o *File) chunkEnd() int64 {
+	if len(o.Chunks) == 0 {
+		return 0
+	}
+	last := o.Chunks[len(o.Chunks)-1]
+	return last.Offset + last.Size
+}
+
+// chunkIndex returns index of the chunk which contains off
+func (o *File) chunkIndex(off int64) int {
+	return sort.Search(len(o.Chunks), func(i int) bool {
+		return o.Chunks[i].Offset+o.Chunks[i].Size > off
+	})
+}
+
+func (o *File) readChunks(dest []byte, off int64) (int, error) {
+	size := int64(len(dest))
+	if off+size > o.Meta.Size {
+		size = o.Meta.Size - off
+	}
+	if size <= 0 {
+		return 0, nil
+	}
+	dest = dest[:size]
+	for i := range dest {
+		dest[i] = 0
+	}
+
+	first := o.chunkIndex(off)
+	last := o.chunkIndex(off + size - 1)
+	if last == len(o.Chunks) {
+		last--
+	}
+
+	// Get chunks concurrently
+	var wg sync.WaitGroup
+	errc := make(chan error, last-first+1)
+	for i := first; i <= last; i++ {
+		wg.Add(1)
+		go func(c *Extent) {
+			defer wg.Done()
+			if c.isHole() {
+				return
+			}
+			// Copy overlapped area
+			//   chunk: |----=====|
+			//   dest:       |=====---|
+			start := off - c.Offset
+			destStart := int64(0)
+			if start < 0 {
+				destStart = -start
+				start = 0
+			}
+			destEnd := destStart + c.Size - start
+			if destEnd > int64(len(dest)) {
+				destEnd = int64(len(dest))
+			}
+			err := c.ReadAt(dest[destStart:destEnd], start, c.Size)
+			if err != nil {
+				o.sess.logger.Error("ReadAt failed", zap.Error(err))
+				errc <- err
+			}
+		}(o.Chunks[i])
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errc:
+		return 0, err
+	default:
+		return len(dest), nil
+	}
+}
+
+func (o *File) writeChunks(data []byte, off int64) error {
+	end := o.chunkEnd()
+	if off > end {
+		o.Chunks = append(o.Chunks, &Extent{
+			Offset: end,
+			Size:   off - end,
+			sess:   o.sess,
+		})
+	}
+
+	// Overwrite existing chunks
+	pos := 0
+	for i := o.chunkIndex(off); i < len(o.Chunks) && pos < len(data); i++ {
+		if o.Chunks[i].isHole() {
+			o.splitHole(i, off+int64(pos), off+int64(len(data)))
+			if o.Chunks[i].isHole() {
+				i++ // the hole before the write
+			}
+		}
+		c := o.Chunks[i]
+		err := c.Fill()
+		if err != nil {
+			return err
+		}
+		start := off + int64(pos) - c.Offset
+		pos += copy(c.body[start:], data[pos:])
+		c.dirty = true
+	}
+
+	// Append the rest, chunks are cut again on Save.
+	max := newChunker(o.ExtentSize).max
+	for pos < len(data) {
+		var last *Extent
+		if len(o.Chunks) > 0 {
+			last = o.Chunks[len(o.Chunks)-1]
+		}
+		if last == nil || !last.dirty || len(last.body) >= max {
+			last = &Extent{
+				Offset: o.chunkEnd(),
+				dirty:  true,
+				sess:   o.sess,
+			}
+			o.Chunks = append(o.Chunks, last)
+		}
+		n := max - len(last.body)
+		if n > len(data)-pos {
+			n = len(data) - pos
+		}
+		last.body = append(last.body, data[pos:pos+n]...)
+		last.Size = int64(len(last.body))
+		pos += n
+	}
+
+	return nil
+}
+
+// splitHole cuts the part of the hole at i which is overwritten by
+// [off, end) out as a chunk of zeros, the rest is left as holes.
+func (o *File) splitHole(i int, off, end int64) {
+	c := o.Chunks[i]
+	start, stop := c.Offset, c.Offset+c.Size
+	if off > start {
+		start = off
+	}
+	if end < stop {
+		stop = end
+	}
+
+	parts := make([]*Extent, 0, 3)
+	if start > c.Offset {
+		parts = append(parts, &Extent{Offset: c.Offset, Size: start - c.Offset, sess: o.sess})
+	}
+	parts = append(parts, &Extent{
+		Offset: start,
+		Size:   stop - start,
+		body:   make([]byte, stop-start),
+		dirty:  true,
+		sess:   o.sess,
+	})
+	if stop < c.Offset+c.Size {
+		parts = append(parts, &Extent{Offset: stop, Size: c.Offset + c.Size - stop, sess: o.sess})
+	}
+	o.Chunks = append(o.Chunks[:i], append(parts, o.Chunks[i+1:]...)...)
+}
+
+// truncateChunks drops chunks beyond size, and cuts the last chunk.
+// Growth is appended as a hole.
+func (o *File) truncateChunks(size int64) error {
+	end := o.chunkEnd()
+	if size >= end {
+		if size > end {
+			o.Chunks = append(o.Chunks, &Extent{
+				Offset: end,
+				Size:   size - end,
+				sess:   o.sess,
+			})
+		}
+		return nil
+	}
+
+	i := o.chunkIndex(size)
+	o.Chunks = o.Chunks[:i+1]
+	c := o.Chunks[i]
+	if c.Offset == size {
+		o.Chunks = o.Chunks[:i]
+		return nil
+	}
+	if c.isHole() {
+		c.Size = size - c.Offset
+		return nil
+	}
+	err := c.Fill()
+	if err != nil {
+		return err
+	}
+	c.body = c.body[:size-c.Offset]
+	c.Size = size - c.Offset
+	c.dirty = true
+	return nil
+}
+
+// rechunk cuts dirty chunks again by content. Cutting continues into the
+// following clean chunks, until a boundary matches the old one.
+func (o *File) rechunk() error {
+	chunker := newChunker(o.ExtentSize)
+	result := make([]*Extent, 0, len(o.Chunks))
+
+	i := 0
+	for i < len(o.Chunks) {
+		if !o.Chunks[i].dirty {
+			result = append(result, o.Chunks[i])
+			i++
+			continue
+		}
+
+		pos := o.Chunks[i].Offset
+		buf := []byte{}
+		clean := false // the last chunk in buf is not modified
+		for {
+			final := i == len(o.Chunks) || o.Chunks[i].isHole()
+			for {
+				n := chunker.Cut(buf, final)
+				if n == 0 {
+					break
+				}
+				result = append(result, o.newChunk(pos, buf[:n]))
+				pos += int64(n)
+				buf = buf[n:]
+			}
+			if final || (clean && len(buf) == 0) {
+				break
+			}
+
+			c := o.Chunks[i]
+			err := c.Fill()
+			if err != nil {
+				return err
+			}
+			buf = append(buf, c.body...)
+			clean = !c.dirty
+			i++
+		}
+	}
+
+	o.sess.logger.Debug("rechunk", zap.Int("before", len(o.Chunks)), zap.Int("after", len(result)))
+	o.Chunks = result
+	return nil
+}
+
+func (o *File) newChunk(offset int64, data []byte) *Extent {
+	c := &Extent{
+		Offset: offset,
+		Size:   int64(len(data)),
+		body:   append([]byte{}, data...),
+		dirty:  true,
+		sess:   o.sess,
+	}
+	c.Key = c.CurrentKey()
+	return c
+}
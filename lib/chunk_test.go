@@ -0,0 +1,61 @@
+package bucketsync
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestWriteChunksIntoHole(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.Chunking = ChunkingCDC
+
+	fs := mountTestFS(t, config)
+	defer fs.Close()
+	writeTestFile(t, fs, "sparse", nil)
+	size := int64(512 << 20)
+	if status := fs.Truncate("sparse", uint64(size), testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+
+	file, status := fs.Open("sparse", uint32(os.O_RDWR), testContext)
+	if status != fuse.OK {
+		t.Fatal(status)
+	}
+	off := size / 2
+	if _, status := file.Write([]byte("hello"), off); status != fuse.OK {
+		t.Fatal(status)
+	}
+	// Only the written bytes are allocated
+	allocated := 0
+	for _, c := range file.(*OpenedFile).file.Chunks {
+		allocated += len(c.body)
+	}
+	if allocated != 5 {
+		t.Fatalf("%d bytes are allocated", allocated)
+	}
+	if status := file.Flush(); status != fuse.OK {
+		t.Fatal(status)
+	}
+	file.Release()
+
+	file, status = fs.Open("sparse", uint32(os.O_RDONLY), testContext)
+	if status != fuse.OK {
+		t.Fatal(status)
+	}
+	defer file.Release()
+	result, status := file.Read(make([]byte, 15), off-5)
+	if status != fuse.OK {
+		t.Fatal(status)
+	}
+	want := append(make([]byte, 5), "hello\x00\x00\x00\x00\x00"...)
+	if got, _ := result.Bytes(nil); !bytes.Equal(got, want) {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+	if attr, _ := fs.GetAttr("sparse", testContext); attr.Size != uint64(size) {
+		t.Fatalf("size = %d", attr.Size)
+	}
+}
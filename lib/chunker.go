@@ -0,0 +1,91 @@
+package bucketsync
+
+// FastCDC content defined chunking
+// https://www.usenix.org/conference/atc16/technical-sessions/presentation/xia
+
+// gearTable is generated from fixed seed, chunk boundaries must be
+// the same on every build.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64
+	seed := uint64(0x6275636b657473) // "buckets"
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+type chunker struct {
+	min   int
+	avg   int
+	max   int
+	maskS uint64 // harder, used before avg
+	maskL uint64 // easier, used after avg
+}
+
+// newChunker returns chunker, which cuts chunks of avg size on average,
+// between avg/4 and avg*4.
+func newChunker(avg int64) *chunker {
+	bits := uint(0)
+	for int64(1)<<(bits+1) <= avg {
+		bits++
+	}
+	if bits < 8 {
+		bits = 8
+	}
+	// Normalized chunking level 2, mask bits are taken from upper side,
+	// they depend on the last 64 bytes.
+	return &chunker{
+		min:   1 << (bits - 2),
+		avg:   1 << bits,
+		max:   1 << (bits + 2),
+		maskS: ^uint64(0) << (64 - (bits + 2)),
+		maskL: ^uint64(0) << (64 - (bits - 2)),
+	}
+}
+
+// Cut returns the length of the first chunk in data.
+// It returns 0 if more data is needed to find a boundary,
+// final means that there is no more data.
+func (c *chunker) Cut(data []byte, final bool) int {
+	n := len(data)
+	if n <= c.min {
+		if final {
+			return n
+		}
+		return 0
+	}
+
+	limit := n
+	if limit > c.max {
+		limit = c.max
+	}
+	normal := c.avg
+	if normal > limit {
+		normal = limit
+	}
+
+	fp := uint64(0)
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < limit; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+
+	if limit == c.max || final {
+		return limit
+	}
+	return 0
+}
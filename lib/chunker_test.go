@@ -0,0 +1,96 @@
+package bucketsync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// cutAll splits data into chunks
+func cutAll(c *chunker, data []byte) [][]byte {
+	chunks := make([][]byte, 0)
+	for len(data) > 0 {
+		n := c.Cut(data, true)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	c := newChunker(4096)
+	if c.min != 1024 || c.avg != 4096 || c.max != 16384 {
+		t.Fatalf("min = %d, avg = %d, max = %d", c.min, c.avg, c.max)
+	}
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	chunks := cutAll(c, data)
+	total := 0
+	for i, chunk := range chunks {
+		if len(chunk) > c.max || (len(chunk) < c.min && i != len(chunks)-1) {
+			t.Fatalf("chunk %d is %d bytes", i, len(chunk))
+		}
+		total += len(chunk)
+	}
+	if total != len(data) {
+		t.Fatalf("chunks are %d bytes, want %d bytes", total, len(data))
+	}
+	if avg := len(data) / len(chunks); avg < c.avg/2 || avg > c.avg*2 {
+		t.Fatalf("average chunk is %d bytes", avg)
+	}
+
+	// Same data is cut at the same boundaries
+	again := cutAll(newChunker(4096), data)
+	if len(again) != len(chunks) {
+		t.Fatalf("%d chunks, then %d chunks", len(chunks), len(again))
+	}
+	for i := range chunks {
+		if len(again[i]) != len(chunks[i]) {
+			t.Fatalf("chunk %d is %d bytes, then %d bytes", i, len(chunks[i]), len(again[i]))
+		}
+	}
+}
+
+func TestChunkerNeedsMoreData(t *testing.T) {
+	c := newChunker(4096)
+	if n := c.Cut(make([]byte, c.min), false); n != 0 {
+		t.Fatalf("cut %d bytes of short data", n)
+	}
+	if n := c.Cut(make([]byte, c.min), true); n != c.min {
+		t.Fatalf("cut %d bytes of final data", n)
+	}
+	// Zeros never match the mask, they are cut at max
+	if n := c.Cut(make([]byte, c.max+1), false); n != c.max {
+		t.Fatalf("cut %d bytes of zeros", n)
+	}
+	if n := c.Cut(make([]byte, c.max-1), false); n != 0 {
+		t.Fatalf("cut %d bytes of zeros before max", n)
+	}
+}
+
+func TestChunkerShift(t *testing.T) {
+	c := newChunker(4096)
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(2)).Read(data)
+	shifted := append([]byte("inserted"), data...)
+
+	// Boundaries after the insertion are found again
+	known := make(map[string]bool)
+	for _, chunk := range cutAll(c, data) {
+		known[string(chunk)] = true
+	}
+	chunks := cutAll(c, shifted)
+	shared := 0
+	for _, chunk := range chunks {
+		if known[string(chunk)] {
+			shared++
+		}
+	}
+	if shared < len(chunks)-2 {
+		t.Fatalf("%d of %d chunks are shared", shared, len(chunks))
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), shifted) {
+		t.Fatal("chunks don't make the data")
+	}
+}
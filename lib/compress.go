@@ -0,0 +1,152 @@
+package bucketsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+// Compression codecs, ID is recorded in object header.
+const (
+	codecNone   byte = 0
+	codecGzip   byte = 1
+	codecZstd   byte = 2
+	codecLZ4    byte = 3
+	codecSnappy byte = 4
+)
+
+// Codec names for config
+const (
+	CodecGzip   = "gzip"
+	CodecZstd   = "zstd"
+	CodecLZ4    = "lz4"
+	CodecSnappy = "snappy"
+)
+
+type Codec interface {
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// NewCodec returns Codec by name, empty name means zstd.
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case CodecGzip:
+		return codecs[codecGzip], nil
+	case "", CodecZstd:
+		return codecs[codecZstd], nil
+	case CodecLZ4:
+		return codecs[codecLZ4], nil
+	case CodecSnappy:
+		return codecs[codecSnappy], nil
+	default:
+		return nil, errors.Errorf("unknown compression codec %q", name)
+	}
+}
+
+// codecs are used for decompression, objects in a bucket can be
+// compressed by different codecs.
+var codecs = map[byte]Codec{
+	codecGzip:   gzipCodec{},
+	codecZstd:   newZstdCodec(),
+	codecLZ4:    lz4Codec{},
+	codecSnappy: snappyCodec{},
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() byte { return codecGzip }
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	w := gzip.NewWriter(out)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// zstd encoder and decoder are safe for concurrent use with EncodeAll and DecodeAll
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCodec() *zstdCodec {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+	return &zstdCodec{
+		encoder: encoder,
+		decoder: decoder,
+	}
+}
+
+func (c *zstdCodec) ID() byte { return codecZstd }
+
+func (c *zstdCodec) Compress(data []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCodec) Decompress(data []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(data, nil)
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) ID() byte { return codecLZ4 }
+
+func (lz4Codec) Compress(data []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	w := lz4.NewWriter(out)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (lz4Codec) Decompress(data []byte) ([]byte, error) {
+	return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(data)))
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte { return codecSnappy }
+
+func (snappyCodec) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCodec) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
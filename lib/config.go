@@ -1,20 +1,121 @@
 package bucketsync
 
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Chunking modes of file content
+const (
+	ChunkingFixed = "fixed"
+	ChunkingCDC   = "cdc"
+)
+
+// Storage backends
+const (
+	BackendS3    = "s3"
+	BackendLocal = "local"
+)
+
 type Config struct {
+	Backend       string `yaml:"backend"`
 	Bucket        string `yaml:"bucket"`
 	Region        string `yaml:"region"`
 	AccessKey     string `yaml:"access_key"`
 	SecretKey     string `yaml:"secret_key"`
+	LocalPath     string `yaml:"local_path"`
 	Password      string `yaml:"password"`
+	KeyFile       string `yaml:"key_file"`
 	Logging       string `yaml:"logging"`
 	LogOutputPath string `yaml:"log_output_path"`
-	CacheSize     int    `yaml:"cache_size"`
+	CacheSize     int    `yaml:"cache_size"` // MiB
+	DiskCacheDir  string `yaml:"disk_cache_dir"`
+	DiskCacheSize int    `yaml:"disk_cache_size"` // MiB
 	ExtentSize    int64  `yaml:"extent_size"`
+	Chunking      string `yaml:"chunking"`
 	Encryption    bool   `yaml:"encryption"`
 	Compression   bool   `yaml:"compression"`
+	// CompressionCodec is gzip, zstd, lz4 or snappy
+	CompressionCodec string `yaml:"compression_codec"`
+
+	// Write-back mode stages objects in WriteBackDir and uploads them
+	// in background.
+	WriteBack         bool   `yaml:"write_back"`
+	WriteBackDir      string `yaml:"write_back_dir"`
+	UploadConcurrency int    `yaml:"upload_concurrency"`
+	// Packing uploads staged objects together as packs of PackSize (MiB),
+	// it requires write-back mode.
+	Packing  bool `yaml:"packing"`
+	PackSize int  `yaml:"pack_size"`
+
+	// Failed S3 requests are retried Retries times (default 5, -1 disables),
+	// each attempt times out after RequestTimeout seconds (default 60).
+	Retries        int `yaml:"retries"`
+	RequestTimeout int `yaml:"request_timeout"`
+
+	// Objects larger than MultipartThreshold (MiB) are uploaded to S3 in
+	// parts of MultipartPartSize (MiB), MultipartConcurrency parts at once.
+	MultipartThreshold   int `yaml:"multipart_threshold"`
+	MultipartPartSize    int `yaml:"multipart_part_size"`
+	MultipartConcurrency int `yaml:"multipart_concurrency"`
+
+	// ReadaheadSize is memory budget of prefetch for sequential read, MiB
+	ReadaheadSize int `yaml:"readahead_size"`
+
+	// PathWalk results and attributes are cached for EntryTimeout and
+	// AttrTimeout seconds, the kernel caches them for the same time.
+	// Changes by other clients are visible after the longer one.
+	EntryTimeout float64 `yaml:"entry_timeout"`
+	AttrTimeout  float64 `yaml:"attr_timeout"`
+
+	// JournalDir keeps writes which are not saved yet, for crash recovery.
+	JournalDir string `yaml:"journal_dir"`
+
+	// QuotaSize (MiB) and QuotaInodes limit total file size and the number
+	// of nodes, 0 is unlimited.
+	QuotaSize   int64 `yaml:"quota_size"`
+	QuotaInodes int64 `yaml:"quota_inodes"`
 }
 
 func (c *Config) validate() bool {
-	// TODO
+	switch c.Backend {
+	case "", BackendS3:
+	case BackendLocal:
+		if c.LocalPath == "" {
+			return false
+		}
+	default:
+		return false
+	}
+	if c.WriteBack && c.WriteBackDir == "" {
+		return false
+	}
+	if c.Packing && !c.WriteBack {
+		return false
+	}
+	switch c.Chunking {
+	case "", ChunkingFixed, ChunkingCDC:
+	default:
+		return false
+	}
 	return true
 }
+
+// PasswordEnv is environment variable name for password,
+// it overrides key_file and password in config.yml.
+const PasswordEnv = "BUCKETSYNC_PASSWORD"
+
+func (c *Config) password() (string, error) {
+	if password := os.Getenv(PasswordEnv); password != "" {
+		return password, nil
+	}
+	if c.KeyFile != "" {
+		data, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return c.Password, nil
+}
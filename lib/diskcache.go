@@ -0,0 +1,223 @@
+package bucketsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// DiskCache keeps objects in a local directory. Objects are stored as they
+// are in the backend, encrypted if encryption is enabled.
+//
+// Extents never go stale, they are kept across mounts. Metadata objects
+// are rewritten in place, and another client may have changed them, so
+// they expire after metaTimeout and are cleared on startup. The kind is
+// told by Storage, a key doesn't tell it: the root key of old buckets is
+// short hex like old extents.
+type DiskCache struct {
+	dir          string
+	maxBytes     int64
+	metaTimeout  time.Duration
+	logger       *Logger
+	lock         sync.Mutex
+	currentBytes int64
+}
+
+const (
+	diskCacheExtentDir = "extent"
+	diskCacheMetaDir   = "meta"
+)
+
+// NewDiskCache returns DiskCache of the bucket. Cache directory is
+// separated for each bucket, so it can be shared by mounts of the same
+// bucket.
+func NewDiskCache(config *Config, logger *Logger) (*DiskCache, error) {
+	id := sha256.Sum256([]byte(config.Backend + "\x00" + config.Bucket + "\x00" + config.LocalPath))
+	dir := filepath.Join(config.DiskCacheDir, hex.EncodeToString(id[:8]))
+
+	err := os.RemoveAll(filepath.Join(dir, diskCacheMetaDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{diskCacheExtentDir, diskCacheMetaDir} {
+		err = os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := &DiskCache{
+		dir:         dir,
+		maxBytes:    int64(config.DiskCacheSize) << 20,
+		metaTimeout: metaTimeout(config),
+		logger:      logger,
+	}
+
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		c.currentBytes += file.Size()
+	}
+	logger.Debug("Disk cache opened", zap.String("dir", dir), zap.Int64("bytes", c.currentBytes))
+	return c, nil
+}
+
+func (c *DiskCache) path(key ObjectKey, kind objectKind) string {
+	if kind == kindExtent {
+		return filepath.Join(c.dir, diskCacheExtentDir, filepath.Base(key))
+	}
+	return filepath.Join(c.dir, diskCacheMetaDir, filepath.Base(key))
+}
+
+// get returns the cached object
+func (c *DiskCache) get(key ObjectKey, kind objectKind) ([]byte, bool) {
+	if kind == kindMeta && c.expired(key) {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(c.path(key, kind))
+	if err != nil {
+		return nil, false
+	}
+	// mtime is used for LRU, and for expiration of metadata
+	if kind == kindExtent {
+		now := time.Now()
+		os.Chtimes(c.path(key, kind), now, now)
+	}
+	return data, true
+}
+
+// expired removes the metadata object cached before metaTimeout
+func (c *DiskCache) expired(key ObjectKey) bool {
+	info, err := os.Stat(c.path(key, kindMeta))
+	if err != nil {
+		return true
+	}
+	if time.Since(info.ModTime()) < c.metaTimeout {
+		return false
+	}
+	c.remove(key, kindMeta)
+	return true
+}
+
+// getRange reads the range from cached object,
+// a part of object is not cached.
+func (c *DiskCache) getRange(key ObjectKey, kind objectKind, offset, length int64) ([]byte, bool) {
+	data, err := readFileRange(c.path(key, kind), offset, length)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(c.path(key, kind), now, now)
+	return data, true
+}
+
+// add writes data to the cache. Cache is best effort, error is only logged.
+func (c *DiskCache) add(key ObjectKey, kind objectKind, data []byte) {
+	if int64(len(data)) > c.maxBytes || (kind == kindMeta && c.metaTimeout <= 0) {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		c.logger.Warn("disk cache write failed", zap.Error(err))
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key, kind))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		c.logger.Warn("disk cache write failed", zap.Error(err))
+		return
+	}
+
+	c.lock.Lock()
+	c.currentBytes += int64(len(data))
+	over := c.currentBytes > c.maxBytes
+	c.lock.Unlock()
+
+	if over {
+		c.evict()
+	}
+}
+
+// remove deletes the cached object, the old value must not be read after
+// the object is rewritten or deleted.
+func (c *DiskCache) remove(key ObjectKey, kind objectKind) {
+	info, err := os.Stat(c.path(key, kind))
+	if err != nil {
+		return
+	}
+	if os.Remove(c.path(key, kind)) == nil {
+		c.lock.Lock()
+		c.currentBytes -= info.Size()
+		c.lock.Unlock()
+	}
+}
+
+// evict removes least recently used files, until 90% of maxBytes.
+func (c *DiskCache) evict() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	files, err := c.files()
+	if err != nil {
+		c.logger.Warn("disk cache eviction failed", zap.Error(err))
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	total := int64(0)
+	for _, file := range files {
+		total += file.Size()
+	}
+	for _, file := range files {
+		if total <= c.maxBytes/10*9 {
+			break
+		}
+		err := os.Remove(file.path)
+		if err != nil {
+			continue
+		}
+		total -= file.Size()
+	}
+	c.currentBytes = total
+}
+
+type cachedFile struct {
+	os.FileInfo
+	path string
+}
+
+func (c *DiskCache) files() ([]cachedFile, error) {
+	files := make([]cachedFile, 0)
+	for _, sub := range []string{diskCacheExtentDir, diskCacheMetaDir} {
+		infos, err := ioutil.ReadDir(filepath.Join(c.dir, sub))
+		if err != nil {
+			return nil, errors.Wrap(err, "ReadDir failed")
+		}
+		for _, info := range infos {
+			files = append(files, cachedFile{
+				FileInfo: info,
+				path:     filepath.Join(c.dir, sub, info.Name()),
+			})
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,99 @@
+package bucketsync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheAcrossMounts(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.DiskCacheDir = filepath.Join(filepath.Dir(config.LocalPath), "cache")
+	config.DiskCacheSize = 1
+	config.AttrTimeout = 60
+	logger, err := NewLogger(config.LogOutputPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewDiskCache(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extent := bytes.Repeat([]byte("e"), 100)
+	c.add("extent", kindExtent, extent)
+	c.add("meta", kindMeta, []byte("meta"))
+	c.add("big", kindExtent, make([]byte, 2<<20))
+	if _, ok := c.get("big", kindExtent); ok {
+		t.Fatal("object larger than the cache is added")
+	}
+	if data, ok := c.get("meta", kindMeta); !ok || string(data) != "meta" {
+		t.Fatalf("meta = %q", data)
+	}
+	// Kind is told by the caller
+	if _, ok := c.get("extent", kindMeta); ok {
+		t.Fatal("extent is read as metadata")
+	}
+
+	// Extents are kept, metadata may be stale
+	c, err = NewDiskCache(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := c.get("extent", kindExtent); !ok || !bytes.Equal(data, extent) {
+		t.Fatalf("extent = %q after reopen", data)
+	}
+	if _, ok := c.get("meta", kindMeta); ok {
+		t.Fatal("metadata is kept after reopen")
+	}
+	if c.currentBytes != int64(len(extent)) {
+		t.Fatalf("bytes = %d after reopen", c.currentBytes)
+	}
+}
+
+func TestDiskCacheEvict(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.DiskCacheDir = filepath.Join(filepath.Dir(config.LocalPath), "cache")
+	config.DiskCacheSize = 1
+	logger, err := NewLogger(config.LogOutputPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewDiskCache(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quarter := make([]byte, 256<<10)
+	keys := []ObjectKey{"a", "b", "c", "d"}
+	past := time.Now().Add(-time.Hour)
+	for i, key := range keys {
+		c.add(key, kindExtent, quarter)
+		// mtime is the order of use
+		used := past.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(c.path(key, kindExtent), used, used)
+	}
+	if _, ok := c.get("a", kindExtent); !ok {
+		t.Fatal("a is evicted before the cache is full")
+	}
+
+	// Least recently used files are removed until 90% of the cache
+	c.add("e", kindExtent, quarter)
+	for _, key := range []ObjectKey{"b", "c"} {
+		if _, ok := c.get(key, kindExtent); ok {
+			t.Fatalf("%s is not evicted", key)
+		}
+	}
+	for _, key := range []ObjectKey{"a", "d", "e"} {
+		if _, ok := c.get(key, kindExtent); !ok {
+			t.Fatalf("%s is evicted", key)
+		}
+	}
+	if c.currentBytes != 3*int64(len(quarter)) {
+		t.Fatalf("bytes = %d", c.currentBytes)
+	}
+}
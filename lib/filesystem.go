@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
@@ -20,6 +21,17 @@ type Meta struct {
 	Atime time.Time `json:"atime"`
 	Ctime time.Time `json:"ctime"`
 	Mtime time.Time `json:"mtime"`
+	Nlink uint32    `json:"nlink,omitempty"` // 0 is 1, written by older versions
+
+	XAttrs map[string]*XAttr `json:"xattrs,omitempty"`
+}
+
+// Links returns the number of directory entries of the node
+func (m Meta) Links() uint32 {
+	if m.Nlink == 0 {
+		return 1
+	}
+	return m.Nlink
 }
 
 // Node is common part of Directory, File, and SymLink
@@ -40,23 +52,51 @@ func (o *Directory) Save() error {
 	if err != nil {
 		return err
 	}
-	return o.sess.s3.UploadWithCache(o.Key, bytes.NewReader(result))
+	o.sess.metaCache.invalidateMeta(o.Key)
+	return o.sess.storage.UploadWithCache(o.Key, bytes.NewReader(result), kindMeta)
 }
 
+// File has Extent map in ChunkingFixed mode, and Chunks in ChunkingCDC mode.
+// ExtentSize is average chunk size in ChunkingCDC mode.
 type File struct {
 	Key        ObjectKey         `json:"key"`
 	Meta       Meta              `json:"meta"`
 	ExtentSize int64             `json:"extent_size"`
 	Extent     map[int64]*Extent `json:"extent"`
+	Chunking   string            `json:"chunking,omitempty"`
+	Chunks     []*Extent         `json:"chunks,omitempty"`
 	sess       *Session
 	dirty      bool
+	savedSize  int64 // Meta.Size in the bucket, for usage counters
+	reserved   int64 // quota reserved for growth beyond savedSize
+	unlinked   bool  // last link is removed while it's opened, not counted in usage
+}
+
+func (o *File) extents() []*Extent {
+	extents := make([]*Extent, 0, len(o.Extent)+len(o.Chunks))
+	for _, e := range o.Extent {
+		extents = append(extents, e)
+	}
+	for _, e := range o.Chunks {
+		if !e.isHole() {
+			extents = append(extents, e)
+		}
+	}
+	return extents
 }
 
 func (o *File) Save() error {
+	if o.Chunking == ChunkingCDC {
+		err := o.rechunk()
+		if err != nil {
+			return err
+		}
+	}
+
 	wg := sync.WaitGroup{}
 	errc := make(chan error)
 	done := make(chan struct{})
-	for _, e := range o.Extent {
+	for _, e := range o.extents() {
 		wg.Add(1)
 		go func(e *Extent) {
 			if !e.dirty {
@@ -64,11 +104,14 @@ func (o *File) Save() error {
 				return
 			}
 			key := e.CurrentKey()
-			if o.sess.s3.IsExist(key) {
+			// Existing extent is touched, it may be unreferenced and
+			// collected by gc running now. Upload anyway if it's unknown,
+			// extent can be overwritten.
+			if touched, err := o.sess.storage.Touch(key); err == nil && touched {
 				wg.Done()
 				return
 			}
-			err := o.sess.s3.Upload(key, bytes.NewReader(e.body))
+			err := o.sess.storage.Upload(key, bytes.NewReader(e.body), kindExtent)
 			if err != nil {
 				errc <- err
 				return
@@ -90,20 +133,118 @@ func (o *File) Save() error {
 		if err != nil {
 			return err
 		}
-		err = o.sess.s3.UploadWithCache(o.Key, bytes.NewReader(result))
+		o.sess.metaCache.invalidateMeta(o.Key)
+		err = o.sess.storage.UploadWithCache(o.Key, bytes.NewReader(result), kindMeta)
 		if err != nil {
 			return err
 		}
+		if !o.unlinked {
+			o.sess.usage.add(o.Meta.Size-o.savedSize, 0)
+		}
+		o.savedSize = o.Meta.Size
+		o.release()
 		return nil
 	}
 
 }
 
+// reserve reserves quota for growth of the file up to size bytes,
+// it's released when the file is saved.
+func (o *File) reserve(size int64) error {
+	n := size - o.savedSize - o.reserved
+	if n <= 0 {
+		return nil
+	}
+	err := o.sess.usage.reserveBytes(n)
+	if err != nil {
+		return err
+	}
+	o.reserved += n
+	return nil
+}
+
+// release releases the reservation, if the file is saved or discarded
+func (o *File) release() {
+	o.sess.usage.releaseBytes(o.reserved)
+	o.reserved = 0
+}
+
+// mergeMeta reloads attributes which are changed by path, not by opened
+// file, so that saving an opened file doesn't revert them. chmod and
+// chown are always handled by path, permission of the caller is checked.
+func (o *File) mergeMeta() error {
+	node, err := o.sess.NewNode(o.Key)
+	if errors.Cause(err) == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	o.Meta.Mode = node.Meta.Mode
+	o.Meta.UID = node.Meta.UID
+	o.Meta.GID = node.Meta.GID
+	o.Meta.Nlink = node.Meta.Nlink
+	o.Meta.XAttrs = node.Meta.XAttrs
+	return nil
+}
+
+// Extent is a block of file content.
+// Offset and Size are used only for chunks.
 type Extent struct {
-	Key   ObjectKey `json:"key"`
-	body  []byte    // call Fill() to use this
-	dirty bool
-	sess  *Session
+	Key    ObjectKey `json:"key"`
+	Offset int64     `json:"offset,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	body   []byte    // call Fill() to use this
+	dirty  bool
+	sess   *Session
+}
+
+// Truncate changes the file size. Extents beyond the end are dropped, and
+// the tail of the last extent is zeroed, so growing the file again reads
+// zeros. Growth is a sparse hole.
+func (o *File) Truncate(size int64) error {
+	err := o.reserve(size)
+	if err != nil {
+		return err
+	}
+
+	if o.Chunking == ChunkingCDC {
+		err = o.truncateChunks(size)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Data beyond the old size must be zero, before it's exposed.
+		end := size
+		if o.Meta.Size < end {
+			end = o.Meta.Size
+		}
+		for i, e := range o.Extent {
+			start := i * o.ExtentSize
+			if start >= end {
+				delete(o.Extent, i)
+				continue
+			}
+			if start+o.ExtentSize <= end {
+				continue
+			}
+			err := e.Fill()
+			if err != nil {
+				return err
+			}
+			tail := e.body[end-start:]
+			for j := range tail {
+				tail[j] = 0
+			}
+			e.dirty = true
+			e.Key = e.CurrentKey()
+		}
+	}
+
+	o.Meta.Size = size
+	o.Meta.Mtime = time.Now()
+	o.Meta.Ctime = o.Meta.Mtime
+	return nil
 }
 
 func (e *Extent) CurrentKey() ObjectKey {
@@ -115,11 +256,12 @@ func (e *Extent) Fill() error {
 		e.sess.logger.Debug("Already filled")
 		return nil
 	}
-	body, err := e.sess.s3.Download(e.Key)
+	body, err := e.sess.storage.DownloadWithCache(e.Key, kindExtent)
 	if err != nil {
 		return err
 	}
-	e.body = body
+	// body is modified by Write, cached value must not be shared.
+	e.body = append([]byte{}, body...)
 	e.sess.logger.Debug("Fill Extent", zap.Int("body size", len(e.body)))
 	return nil
 }
@@ -131,12 +273,35 @@ type SymLink struct {
 	sess   *Session
 }
 
+// ReadAt copies the extent from off to dest, size is size of the extent.
+// If only a small part is needed, it is read by range request without
+// filling the extent.
+func (e *Extent) ReadAt(dest []byte, off int64, size int64) error {
+	if !e.dirty && len(e.body) == 0 && int64(len(dest))*2 < size {
+		body, err := e.sess.storage.DownloadRange(e.Key, off, int64(len(dest)))
+		if err != nil {
+			return err
+		}
+		copy(dest, body)
+		return nil
+	}
+	err := e.Fill()
+	if err != nil {
+		return err
+	}
+	if off < int64(len(e.body)) {
+		copy(dest, e.body[off:])
+	}
+	return nil
+}
+
 func (o *SymLink) Save() error {
 	result, err := json.Marshal(o)
 	if err != nil {
 		return err
 	}
-	return o.sess.s3.UploadWithCache(o.Key, bytes.NewReader(result))
+	o.sess.metaCache.invalidateMeta(o.Key)
+	return o.sess.storage.UploadWithCache(o.Key, bytes.NewReader(result), kindMeta)
 }
 
 func NewMeta(mode uint32, context *fuse.Context) Meta {
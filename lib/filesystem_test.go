@@ -0,0 +1,87 @@
+package bucketsync
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func testTruncate(t *testing.T, chunking string) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.Chunking = chunking
+
+	fs := mountTestFS(t, config)
+	data := make([]byte, 10*config.ExtentSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeTestFile(t, fs, "file", data)
+
+	// Shrink into the middle of an extent
+	size := 3*config.ExtentSize + 10
+	if status := fs.Truncate("file", uint64(size), testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	want := data[:size]
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Fatalf("shrink: read %d bytes, want %d bytes", len(got), len(want))
+	}
+
+	// Grow, the tail of the last extent must be zeros
+	size = 6 * config.ExtentSize
+	if status := fs.Truncate("file", uint64(size), testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	want = append(append([]byte{}, want...), make([]byte, size-int64(len(want)))...)
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Fatalf("grow: read %d bytes, want %d bytes", len(got), len(want))
+	}
+
+	// Truncate of an opened file is saved with its writes
+	file, status := fs.Open("file", uint32(os.O_WRONLY), testContext)
+	if status != fuse.OK {
+		t.Fatal(status)
+	}
+	if _, status := file.Write([]byte("tail"), 8*config.ExtentSize); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if status := fs.Truncate("file", 100, testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	file.Flush()
+	file.Release()
+	want = want[:100]
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Fatalf("opened: read %d bytes, want %d bytes", len(got), len(want))
+	}
+
+	// O_TRUNC
+	file, status = fs.Open("file", uint32(os.O_WRONLY|syscall.O_TRUNC), testContext)
+	if status != fuse.OK {
+		t.Fatal(status)
+	}
+	file.Flush()
+	file.Release()
+	if status := fs.Truncate("file", 50, testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	want = make([]byte, 50)
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Fatal("stale data after O_TRUNC")
+	}
+
+	// Fresh session reads the same
+	fs.Close()
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Fatal("remount: content mismatch")
+	}
+}
+
+func TestTruncateFixed(t *testing.T) { testTruncate(t, ChunkingFixed) }
+
+func TestTruncateCDC(t *testing.T) { testTruncate(t, ChunkingCDC) }
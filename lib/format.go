@@ -0,0 +1,188 @@
+package bucketsync
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Every object body is stored with the header below.
+//
+//	offset 0: magic "BKSY"
+//	offset 4: format version
+//	offset 5: cipher algorithm
+//	offset 6: compression codec (version 2 or later)
+//	offset 7: body, compressed by the codec, then encrypted by the cipher
+//
+// Version 1 header has no codec, its body is not compressed.
+//
+// AES-GCM body is nonce | ciphertext | tag, the header and the key are
+// authenticated. Segmented AES-GCM is used for uncompressed body larger
+// than a segment, each segment is sealed separately so that a range of
+// the object can be read. AES-CTR is only for reading objects written by
+// older versions.
+//
+// Objects written before the header was introduced have no magic,
+// they are plaintext.
+const (
+	objectMagic          = "BKSY"
+	objectVersion   byte = 2
+	objectHeaderLen      = 7
+)
+
+// Cipher algorithms
+const (
+	cipherNone            byte = 0
+	cipherAESCTR          byte = 1 // read only
+	cipherAESGCM          byte = 2
+	cipherAESGCMSegmented byte = 3
+)
+
+// segmentSize is plaintext size of a segment of cipherAESGCMSegmented
+const segmentSize = 64 * 1024
+
+var (
+	ErrEncryptedObject   = errors.New("object is encrypted, but encryption is disabled")
+	ErrUnencryptedObject = errors.New("object is not encrypted, but encryption is enabled")
+	ErrUnknownFormat     = errors.New("unknown object format")
+	ErrCorruptObject     = errors.New("object is corrupted or tampered")
+)
+
+// objectHeader is parsed header
+type objectHeader struct {
+	version byte
+	cipher  byte
+	codec   byte
+	len     int
+}
+
+func parseObjectHeader(data []byte) (*objectHeader, error) {
+	if len(data) < 6 {
+		return nil, ErrUnknownFormat
+	}
+	header := &objectHeader{
+		version: data[4],
+		cipher:  data[5],
+		codec:   codecNone,
+	}
+	switch header.version {
+	case 1:
+		header.len = 6
+	case 2:
+		if len(data) < 7 {
+			return nil, ErrUnknownFormat
+		}
+		header.codec = data[6]
+		header.len = 7
+	default:
+		return nil, ErrUnknownFormat
+	}
+	return header, nil
+}
+
+func (s *Storage) encode(key ObjectKey, data []byte) ([]byte, error) {
+	codec := codecNone
+	if s.codec != nil {
+		compressed, err := s.codec.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		// Store raw data if it doesn't compress
+		if len(compressed) < len(data) {
+			data = compressed
+			codec = s.codec.ID()
+		}
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString(objectMagic)
+	out.WriteByte(objectVersion)
+
+	if s.cipher == nil {
+		out.WriteByte(cipherNone)
+		out.WriteByte(codec)
+		out.Write(data)
+		return out.Bytes(), nil
+	}
+
+	if codec == codecNone && len(data) > segmentSize {
+		out.WriteByte(cipherAESGCMSegmented)
+		out.WriteByte(codec)
+		sealed, err := s.cipher.SealSegments(out.Bytes(), key, data)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(sealed)
+		return out.Bytes(), nil
+	}
+
+	out.WriteByte(cipherAESGCM)
+	out.WriteByte(codec)
+	sealed, err := s.cipher.Seal(out.Bytes(), key, data)
+	if err != nil {
+		return nil, err
+	}
+	out.Write(sealed)
+	return out.Bytes(), nil
+}
+
+func (s *Storage) decode(key ObjectKey, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(objectMagic)) {
+		if s.cipher != nil {
+			return nil, errors.Wrapf(ErrUnencryptedObject, "key = %s", key)
+		}
+		return data, nil
+	}
+	header, err := parseObjectHeader(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key = %s", key)
+	}
+
+	body := data[header.len:]
+	switch header.cipher {
+	case cipherNone:
+		if s.cipher != nil {
+			return nil, errors.Wrapf(ErrUnencryptedObject, "key = %s", key)
+		}
+	case cipherAESCTR:
+		if s.cipher == nil {
+			return nil, errors.Wrapf(ErrEncryptedObject, "key = %s", key)
+		}
+		body, err = ioutil.ReadAll(s.cipher.StreamReader(bytes.NewReader(body), key))
+		if err != nil {
+			return nil, err
+		}
+	case cipherAESGCM:
+		if s.cipher == nil {
+			return nil, errors.Wrapf(ErrEncryptedObject, "key = %s", key)
+		}
+		body, err = s.cipher.Open(data[:header.len], key, body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key = %s", key)
+		}
+	case cipherAESGCMSegmented:
+		if s.cipher == nil {
+			return nil, errors.Wrapf(ErrEncryptedObject, "key = %s", key)
+		}
+		body, err = s.cipher.OpenSegments(data[:header.len], key, body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key = %s", key)
+		}
+	default:
+		return nil, errors.Wrapf(ErrUnknownFormat, "key = %s", key)
+	}
+
+	if header.codec == codecNone {
+		return body, nil
+	}
+	codec, ok := codecs[header.codec]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownFormat, "key = %s", key)
+	}
+	body, err = codec.Decompress(body)
+	if err != nil {
+		return nil, errors.Wrapf(ErrCorruptObject, "key = %s, %s", key, err)
+	}
+	return body, nil
+}
@@ -0,0 +1,61 @@
+package bucketsync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	random := make([]byte, 3*segmentSize+123)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := map[string][]byte{
+		"empty":        {},
+		"small":        []byte("hello"),
+		"compressible": bytes.Repeat([]byte("bucketsync"), segmentSize),
+		"random":       random,
+	}
+	configs := map[string]func(c *Config){
+		"plain":             func(c *Config) { c.Encryption = false; c.Compression = false },
+		"compressed":        func(c *Config) { c.Encryption = false; c.CompressionCodec = CodecGzip },
+		"encrypted":         func(c *Config) { c.Compression = false },
+		"encrypted+zstd":    func(c *Config) { c.CompressionCodec = CodecZstd },
+		"encrypted+lz4":     func(c *Config) { c.CompressionCodec = CodecLZ4 },
+		"encrypted+snappy":  func(c *Config) { c.CompressionCodec = CodecSnappy },
+		"compressed+snappy": func(c *Config) { c.Encryption = false; c.CompressionCodec = CodecSnappy },
+	}
+
+	for name, mod := range configs {
+		config, cleanup := newTestConfig(t)
+		mod(config)
+		fs := mountTestFS(t, config)
+		sess := fs.Sess
+		for input, data := range inputs {
+			key := NewObjectKey()
+			encoded, err := sess.storage.encode(key, data)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", name, input, err)
+			}
+			if config.Encryption && len(data) > 0 && bytes.Contains(encoded, data) {
+				t.Fatalf("%s/%s: plaintext is stored", name, input)
+			}
+			decoded, err := sess.storage.decode(key, encoded)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", name, input, err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Fatalf("%s/%s: decoded %d bytes, want %d bytes", name, input, len(decoded), len(data))
+			}
+
+			// Key is authenticated, an object can't be moved to another key
+			if config.Encryption {
+				_, err = sess.storage.decode(NewObjectKey(), encoded)
+				if err == nil {
+					t.Fatalf("%s/%s: decoded by another key", name, input)
+				}
+			}
+		}
+		fs.Close()
+		cleanup()
+	}
+}
@@ -0,0 +1,347 @@
+package bucketsync
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
+	"github.com/spaolacci/murmur3"
+	"go.uber.org/zap"
+)
+
+// lostFoundName is the directory in the root, broken entries are moved
+// into it by Fsck.
+const lostFoundName = "lost+found"
+
+// Kinds of FsckProblem
+const (
+	ProblemDangling       = "dangling reference"
+	ProblemUndecodable    = "undecodable object"
+	ProblemInvalidMode    = "invalid mode"
+	ProblemMissingExtent  = "missing extent"
+	ProblemExtentMismatch = "extent content mismatch"
+	ProblemSizeMismatch   = "size mismatch"
+	ProblemMissingPack    = "missing pack"
+	ProblemUnavailable    = "unavailable object"
+	ProblemMissingXAttr   = "missing xattr value"
+	ProblemUsageMismatch  = "usage mismatch"
+)
+
+// FsckProblem is an inconsistency found by Fsck
+type FsckProblem struct {
+	Kind   string
+	Path   string
+	Key    ObjectKey
+	Detail string
+}
+
+// FsckReport is the result of Fsck
+type FsckReport struct {
+	Checked  int
+	Problems []FsckProblem
+	Repaired int
+}
+
+type fsckMove struct {
+	parent *Directory
+	name   string
+	key    ObjectKey
+}
+
+type fsck struct {
+	sess   *Session
+	report *FsckReport
+	broken map[ObjectKey]bool // verdict of checked nodes
+	moves  []fsckMove
+	trims  []*File
+}
+
+// Fsck walks the tree from the root, and reports broken references and
+// objects. If repair is true, broken entries are moved into lost+found,
+// extents beyond the file size are dropped, and usage counters are
+// counted again.
+func (s *Session) Fsck(repair bool) (*FsckReport, error) {
+	c := &fsck{
+		sess:   s,
+		report: &FsckReport{Problems: make([]FsckProblem, 0)},
+		broken: make(map[ObjectKey]bool),
+	}
+
+	root, err := s.NewDirectory(s.RootKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "root directory is broken")
+	}
+	c.checkDirectory("/", root)
+	c.checkPacks()
+
+	if repair {
+		err = c.repair(root)
+		if err != nil {
+			return c.report, err
+		}
+	}
+	err = c.checkUsage(repair)
+	if err != nil {
+		return c.report, err
+	}
+	return c.report, nil
+}
+
+func (c *fsck) problem(kind, path string, key ObjectKey, detail string) {
+	c.sess.logger.Debug("fsck", zap.String("kind", kind), zap.String("path", path),
+		zap.String("key", key), zap.String("detail", detail))
+	c.report.Problems = append(c.report.Problems, FsckProblem{
+		Kind:   kind,
+		Path:   path,
+		Key:    key,
+		Detail: detail,
+	})
+}
+
+// checkUsage compares counters of the superblock with the tree. It's
+// skipped if some objects are unavailable, they can't be counted.
+func (c *fsck) checkUsage(repair bool) error {
+	for _, p := range c.report.Problems {
+		if p.Kind == ProblemUnavailable {
+			return nil
+		}
+	}
+	usage := c.sess.usage
+	bytes, inodes := c.sess.countUsage()
+	usedBytes, usedInodes := usage.usage()
+	if bytes == usedBytes && inodes == usedInodes {
+		return nil
+	}
+	c.problem(ProblemUsageMismatch, "", superblockKey,
+		fmt.Sprintf("counted %d bytes and %d inodes, but superblock has %d bytes and %d inodes",
+			bytes, inodes, usedBytes, usedInodes))
+	if !repair {
+		return nil
+	}
+	usage.set(bytes, inodes)
+	err := usage.save(false)
+	if err != nil {
+		return err
+	}
+	c.report.Repaired++
+	return nil
+}
+
+// checkPacks reports indexes whose pack doesn't exist
+func (c *fsck) checkPacks() {
+	packs := c.sess.storage.packs
+	if packs == nil {
+		return
+	}
+	for _, u := range packs.usage(nil) {
+		if exist, err := packs.ObjectStore.IsExist(u.pack); err == nil && !exist {
+			c.problem(ProblemMissingPack, "", u.pack,
+				fmt.Sprintf("%d bytes are indexed", u.total))
+		}
+	}
+}
+
+func (c *fsck) checkDirectory(dirPath string, dir *Directory) {
+	for name, key := range dir.FileMeta {
+		// Already broken entries
+		if dir.Key == c.sess.RootKey() && name == lostFoundName {
+			continue
+		}
+		if c.checkNode(path.Join(dirPath, name), key) {
+			c.moves = append(c.moves, fsckMove{parent: dir, name: name, key: key})
+		}
+	}
+}
+
+// checkNode returns true if the entry should be moved into lost+found.
+// A node is checked once, other hard links get the same verdict.
+func (c *fsck) checkNode(nodePath string, key ObjectKey) bool {
+	if broken, ok := c.broken[key]; ok {
+		return broken
+	}
+	c.broken[key] = false
+	c.report.Checked++
+	broken := c.checkObject(nodePath, key)
+	c.broken[key] = broken
+	return broken
+}
+
+func (c *fsck) checkObject(nodePath string, key ObjectKey) bool {
+
+	// Transient error is reported, but the entry is kept.
+	exist, err := c.sess.storage.IsExist(key)
+	if err != nil {
+		c.problem(ProblemUnavailable, nodePath, key, err.Error())
+		return false
+	}
+	if !exist {
+		c.problem(ProblemDangling, nodePath, key, "")
+		return true
+	}
+
+	node, err := c.sess.NewTypedNode(key)
+	if err != nil {
+		if errors.Cause(err) == ErrInvalidMode {
+			c.problem(ProblemInvalidMode, nodePath, key, err.Error())
+		} else {
+			c.problem(ProblemUndecodable, nodePath, key, err.Error())
+		}
+		return true
+	}
+
+	switch typed := node.(type) {
+	case *Directory:
+		c.checkXAttrs(nodePath, typed.Meta)
+		c.checkDirectory(nodePath, typed)
+	case *File:
+		c.checkXAttrs(nodePath, typed.Meta)
+		return c.checkFile(nodePath, typed)
+	case *SymLink:
+		c.checkXAttrs(nodePath, typed.Meta)
+	}
+	return false
+}
+
+// checkXAttrs reports large xattr values which are lost
+func (c *fsck) checkXAttrs(nodePath string, meta Meta) {
+	keys := make(map[ObjectKey]struct{})
+	meta.addXAttrKeys(keys)
+	for key := range keys {
+		if exist, err := c.sess.storage.IsExist(key); err == nil && !exist {
+			c.problem(ProblemMissingXAttr, nodePath, key, "")
+		}
+	}
+}
+
+func (c *fsck) checkFile(filePath string, file *File) bool {
+	broken := false
+	for _, e := range file.extents() {
+		body, err := c.sess.storage.Download(e.Key, kindExtent)
+		if err != nil {
+			if errors.Cause(err) == ErrNotFound {
+				c.problem(ProblemMissingExtent, filePath, e.Key, "")
+			} else {
+				c.problem(ProblemUndecodable, filePath, e.Key, err.Error())
+			}
+			broken = true
+			continue
+		}
+		if !c.sess.keyMatches(e.Key, body) {
+			c.problem(ProblemExtentMismatch, filePath, e.Key, "")
+			broken = true
+		}
+		if file.Chunking == ChunkingCDC && int64(len(body)) != e.Size {
+			c.problem(ProblemExtentMismatch, filePath, e.Key,
+				fmt.Sprintf("chunk size is %d, but body is %d bytes", e.Size, len(body)))
+			broken = true
+		}
+	}
+	if broken {
+		return true
+	}
+
+	if start := file.lastExtentStart(); start >= file.Meta.Size {
+		c.problem(ProblemSizeMismatch, filePath, file.Key,
+			fmt.Sprintf("size is %d, but an extent starts at %d", file.Meta.Size, start))
+		c.trims = append(c.trims, file)
+	}
+	return false
+}
+
+// lastExtentStart returns the start offset of the last extent,
+// or -1 if there is no extent.
+func (o *File) lastExtentStart() int64 {
+	if o.Chunking == ChunkingCDC {
+		if len(o.Chunks) == 0 {
+			return -1
+		}
+		return o.Chunks[len(o.Chunks)-1].Offset
+	}
+	start := int64(-1)
+	for i := range o.Extent {
+		if i*o.ExtentSize > start {
+			start = i * o.ExtentSize
+		}
+	}
+	return start
+}
+
+// keyMatches checks content address of extent
+func (s *Session) keyMatches(key ObjectKey, body []byte) bool {
+	if len(key) <= 16 { // murmur3, written by older versions
+		return fmt.Sprintf("%x", murmur3.Sum64(body)) == key
+	}
+	return s.KeyGen(body) == key
+}
+
+func (c *fsck) repair(root *Directory) error {
+	for _, file := range c.trims {
+		if file.Chunking == ChunkingCDC {
+			i := file.chunkIndex(file.Meta.Size)
+			if i < len(file.Chunks) && file.Chunks[i].Offset < file.Meta.Size {
+				i++ // partially used
+			}
+			file.Chunks = file.Chunks[:i]
+		} else {
+			for i := range file.Extent {
+				if i*file.ExtentSize >= file.Meta.Size {
+					delete(file.Extent, i)
+				}
+			}
+		}
+		err := file.Save()
+		if err != nil {
+			return err
+		}
+		c.report.Repaired++
+	}
+
+	if len(c.moves) == 0 {
+		return nil
+	}
+
+	modified := make(map[*Directory]bool)
+	var lostFound *Directory
+	if key, ok := root.FileMeta[lostFoundName]; ok {
+		var err error
+		lostFound, err = c.sess.NewDirectory(key)
+		if err != nil {
+			return errors.Wrap(err, "lost+found is broken")
+		}
+	} else {
+		lostFound = c.sess.CreateDirectory(NewObjectKey(), root.Key, 0700, &fuse.Context{})
+		root.FileMeta[lostFoundName] = lostFound.Key
+		modified[root] = true
+		c.sess.usage.add(0, 1)
+	}
+
+	// Entries are named by key, like "#inode" of e2fsck. Hard links of
+	// the same node are numbered, so Nlink stays right.
+	for _, m := range c.moves {
+		name := "#" + m.key
+		for n := 1; ; n++ {
+			if _, ok := lostFound.FileMeta[name]; !ok {
+				break
+			}
+			name = fmt.Sprintf("#%s.%d", m.key, n)
+		}
+		lostFound.FileMeta[name] = m.key
+		delete(m.parent.FileMeta, m.name)
+		modified[m.parent] = true
+	}
+
+	// Save lost+found first, entries never disappear.
+	err := lostFound.Save()
+	if err != nil {
+		return err
+	}
+	for dir := range modified {
+		err := dir.Save()
+		if err != nil {
+			return err
+		}
+	}
+	c.report.Repaired += len(c.moves)
+	return nil
+}
@@ -0,0 +1,74 @@
+package bucketsync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestFsckRepairHardLinks(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	fs := mountTestFS(t, config)
+	if status := fs.Mkdir("dir", 0755, testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	writeTestFile(t, fs, "dir/file", []byte("broken file"))
+	if status := fs.Link("dir/file", "link", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	writeTestFile(t, fs, "kept", []byte("kept file"))
+
+	key, err := fs.Sess.PathWalk("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Sess.NewFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range file.extents() {
+		err := os.Remove(filepath.Join(config.LocalPath, e.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := fs.Sess.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) == 0 || report.Repaired == 0 {
+		t.Fatalf("%+v", report)
+	}
+	fs.Close()
+
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	report, err = fs.Sess.Fsck(false)
+	if err != nil || len(report.Problems) != 0 {
+		t.Fatalf("after repair: %v %v", report.Problems, err)
+	}
+	// Every link is moved, and each is an entry
+	for _, name := range []string{"dir/file", "link"} {
+		if _, status := fs.GetAttr(name, testContext); status != fuse.ENOENT {
+			t.Fatalf("%s: %v", name, status)
+		}
+	}
+	links := []string{"lost+found/#" + key, "lost+found/#" + key + ".1"}
+	for _, name := range links {
+		attr, status := fs.GetAttr(name, testContext)
+		if status != fuse.OK {
+			t.Fatalf("%s: %v", name, status)
+		}
+		if attr.Nlink != uint32(len(links)) {
+			t.Fatalf("%s: nlink = %d", name, attr.Nlink)
+		}
+	}
+	if _, status := fs.GetAttr("kept", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+}
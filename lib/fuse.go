@@ -3,12 +3,15 @@ package bucketsync
 import (
 	"hash/fnv"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
@@ -17,9 +20,11 @@ type FileSystem struct {
 	pathfs.FileSystem
 	Sess   *Session
 	logger *Logger
+
+	handleCalls sync.Map // contexts of requests on a file handle, see rawFileSystem
 }
 
-func NewFileSystem(config *Config) *pathfs.PathNodeFs {
+func NewFileSystem(config *Config) *FileSystem {
 	sess, err := NewSession(config)
 	if err != nil {
 		panic(err)
@@ -30,7 +35,12 @@ func NewFileSystem(config *Config) *pathfs.PathNodeFs {
 		Sess:       sess,
 		logger:     sess.logger,
 	}
-	return pathfs.NewPathNodeFs(fs, nil)
+	return fs
+}
+
+// Close waits for background uploads, call it after unmount.
+func (f *FileSystem) Close() {
+	f.Sess.Close()
 }
 
 func InodeHash(o ObjectKey) uint64 {
@@ -43,62 +53,134 @@ func NewObjectKey() ObjectKey {
 	return uuid.Must(uuid.NewV4()).String()
 }
 
+// errorStatus converts error from Session to fuse status.
+// Only missing objects are ENOENT, broken objects and transient errors
+// shouldn't look like missing files.
+func errorStatus(err error) fuse.Status {
+	switch errors.Cause(err) {
+	case ErrNotFound:
+		return fuse.ENOENT
+	case ErrNoSpace:
+		return fuse.Status(syscall.ENOSPC)
+	}
+	return fuse.EIO
+}
+
 func (f *FileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	f.logger.Debug("GetAttr", zap.String("name", name))
 
-	key, err := f.Sess.PathWalk(name)
-	if err != nil {
-		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return nil, status
 	}
 
-	node, err := f.Sess.NewNode(key)
+	meta, err := f.Sess.NodeMeta(key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return nil, errorStatus(err)
 	}
 
 	attr := &fuse.Attr{
 		Ino:   InodeHash(key),
-		Size:  uint64(node.Meta.Size),
-		Mode:  node.Meta.Mode,
-		Nlink: 1,
+		Size:  uint64(meta.Size),
+		Mode:  meta.Mode,
+		Nlink: meta.Links(),
 		Owner: fuse.Owner{
-			Uid: node.Meta.UID,
-			Gid: node.Meta.GID,
+			Uid: meta.UID,
+			Gid: meta.GID,
 		},
 	}
-	attr.SetTimes(&node.Meta.Atime, &node.Meta.Mtime, &node.Meta.Ctime)
+	attr.SetTimes(&meta.Atime, &meta.Mtime, &meta.Ctime)
 	return attr, fuse.OK
 }
 
 func (f *FileSystem) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
 	f.logger.Debug("Open", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
-	if err != nil {
-		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return nil, status
 	}
 
 	node, err := f.Sess.NewFile(key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return nil, errorStatus(err)
+	}
+	if !c.permits(node.Meta, openPerm(flags)) {
+		return nil, fuse.EACCES
 	}
 
-	return NewOpenedFile(node), fuse.OK
+	opened := NewOpenedFile(node)
+	if flags&syscall.O_TRUNC != 0 {
+		status := opened.truncate(0)
+		if !status.Ok() {
+			return nil, status
+		}
+	}
+	f.Sess.handles.add(opened)
+	return opened, fuse.OK
 }
 
-func (f *FileSystem) getParent(name string) (*Directory, fuse.Status) {
-	parent := filepath.Dir(name)
-	key, err := f.Sess.PathWalk(parent)
+// openPerm returns permission bits required by open(2) flags
+func openPerm(flags uint32) uint32 {
+	var perm uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		perm = permRead
+	case syscall.O_WRONLY:
+		perm = permWrite
+	case syscall.O_RDWR:
+		perm = permRead | permWrite
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		perm |= permWrite
+	}
+	return perm
+}
+
+// walk returns key of the path, if the caller can search all directories
+// on the path.
+func (f *FileSystem) walk(name string, c *caller) (ObjectKey, fuse.Status) {
+	if c.uid != 0 && name != "" {
+		dir := ""
+		for _, p := range strings.Split(name, string(filepath.Separator)) {
+			key, err := f.Sess.PathWalk(dir)
+			if err != nil {
+				f.logger.Debug("fuse error", zap.Error(err))
+				return "", errorStatus(err)
+			}
+			meta, err := f.Sess.NodeMeta(key)
+			if err != nil {
+				f.logger.Debug("fuse error", zap.Error(err))
+				return "", errorStatus(err)
+			}
+			if !c.permits(meta, permExec) {
+				return "", fuse.EACCES
+			}
+			dir = filepath.Join(dir, p)
+		}
+	}
+
+	key, err := f.Sess.PathWalk(name)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return "", errorStatus(err)
+	}
+	return key, fuse.OK
+}
+
+func (f *FileSystem) getParent(name string, c *caller) (*Directory, fuse.Status) {
+	parent := filepath.Dir(name)
+	key, status := f.walk(parent, c)
+	if status != fuse.OK {
+		return nil, status
 	}
 	dir, err := f.Sess.NewDirectory(key)
 	if err != nil {
-		return nil, fuse.EACCES
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, errorStatus(err)
 	}
 	return dir, fuse.OK
 }
@@ -108,16 +190,43 @@ func (f *FileSystem) Rename(oldName string, newName string, context *fuse.Contex
 
 	oldParentPath := filepath.Dir(oldName)
 	newParentPath := filepath.Dir(newName)
+	c := newCaller(context)
+	defer f.Sess.metaCache.invalidatePath(oldName)
+	defer f.Sess.metaCache.invalidatePath(newName)
 
 	if oldParentPath == newParentPath {
 		// Get parent dir
-		dir, status := f.getParent(oldName) // got the same as newName
+		dir, status := f.getParent(oldName, c) // got the same as newName
 		if status != fuse.OK {
 			return status
 		}
+		if !c.permits(dir.Meta, permWrite|permExec) {
+			return fuse.EACCES
+		}
+
+		key, ok := dir.FileMeta[filepath.Base(oldName)]
+		if !ok {
+			return fuse.ENOENT
+		}
+		replaced, ok := dir.FileMeta[filepath.Base(newName)]
+		if ok && replaced == key {
+			// Both are links of the same node
+			return fuse.OK
+		}
+		if status := f.checkSticky(dir, key, c); status != fuse.OK {
+			return status
+		}
+		if ok {
+			if status := f.checkSticky(dir, replaced, c); status != fuse.OK {
+				return status
+			}
+			if status := f.checkEmpty(replaced); status != fuse.OK {
+				return status
+			}
+		}
 
 		// Rename
-		dir.FileMeta[filepath.Base(newName)] = dir.FileMeta[filepath.Base(oldName)]
+		dir.FileMeta[filepath.Base(newName)] = key
 		delete(dir.FileMeta, filepath.Base(oldName))
 
 		// Save
@@ -126,21 +235,48 @@ func (f *FileSystem) Rename(oldName string, newName string, context *fuse.Contex
 			f.logger.Debug("fuse error", zap.Error(err))
 			return fuse.EIO
 		}
+		if ok {
+			return f.unlinkNode(replaced)
+		}
 	} else {
 		// Get old dir
-		dirOld, status := f.getParent(oldName)
+		dirOld, status := f.getParent(oldName, c)
 		if status != fuse.OK {
 			return status
 		}
 
 		// Get new dir
-		dirNew, status := f.getParent(newName)
+		dirNew, status := f.getParent(newName, c)
 		if status != fuse.OK {
 			return status
 		}
+		if !c.permits(dirOld.Meta, permWrite|permExec) || !c.permits(dirNew.Meta, permWrite|permExec) {
+			return fuse.EACCES
+		}
+
+		key, ok := dirOld.FileMeta[filepath.Base(oldName)]
+		if !ok {
+			return fuse.ENOENT
+		}
+		replaced, ok := dirNew.FileMeta[filepath.Base(newName)]
+		if ok && replaced == key {
+			// Both are links of the same node
+			return fuse.OK
+		}
+		if status := f.checkSticky(dirOld, key, c); status != fuse.OK {
+			return status
+		}
+		if ok {
+			if status := f.checkSticky(dirNew, replaced, c); status != fuse.OK {
+				return status
+			}
+			if status := f.checkEmpty(replaced); status != fuse.OK {
+				return status
+			}
+		}
 
 		// Rename
-		dirNew.FileMeta[filepath.Base(newName)] = dirOld.FileMeta[filepath.Base(oldName)]
+		dirNew.FileMeta[filepath.Base(newName)] = key
 		delete(dirOld.FileMeta, filepath.Base(oldName))
 
 		// Save
@@ -154,6 +290,82 @@ func (f *FileSystem) Rename(oldName string, newName string, context *fuse.Contex
 			f.logger.Debug("fuse error", zap.Error(err))
 			return fuse.EIO
 		}
+		if ok {
+			return f.unlinkNode(replaced)
+		}
+	}
+	return fuse.OK
+}
+
+// checkEmpty returns ENOTEMPTY if key is a directory which has entries.
+// Removing it would leave its subtree counted in usage.
+func (f *FileSystem) checkEmpty(key ObjectKey) fuse.Status {
+	node, err := f.Sess.NewTypedNode(key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return errorStatus(err)
+	}
+	if dir, ok := node.(*Directory); ok && len(dir.FileMeta) > 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	return fuse.OK
+}
+
+// checkSticky returns EPERM if the entry can't be removed from the sticky
+// directory, only owners of the entry or the directory can remove it.
+func (f *FileSystem) checkSticky(dir *Directory, key ObjectKey, c *caller) fuse.Status {
+	if dir.Meta.Mode&syscall.S_ISVTX == 0 || c.owns(dir.Meta) {
+		return fuse.OK
+	}
+	meta, err := f.Sess.NodeMeta(key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return errorStatus(err)
+	}
+	if !c.owns(meta) {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// unlinkNode decrements the link count of the node, after its directory
+// entry is removed. The last link is not counted, the node becomes
+// garbage and it's deleted by gc, its usage is released. Handles of the
+// file keep working, but their saves are not counted.
+func (f *FileSystem) unlinkNode(key ObjectKey) fuse.Status {
+	node, err := f.Sess.NewTypedNode(key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return errorStatus(err)
+	}
+
+	switch typed := node.(type) {
+	case *Directory:
+		f.Sess.usage.add(0, -1)
+	case *File:
+		if typed.Meta.Links() > 1 {
+			typed.Meta.Nlink = typed.Meta.Links() - 1
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		} else {
+			f.Sess.usage.add(-typed.Meta.Size, -1)
+			// Opened files are saved later, usage is released already.
+			for _, h := range f.Sess.handles.get(key) {
+				h.file.unlinked = true
+			}
+		}
+	case *SymLink:
+		if typed.Meta.Links() > 1 {
+			typed.Meta.Nlink = typed.Meta.Links() - 1
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		} else {
+			f.Sess.usage.add(0, -1)
+		}
+	}
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return fuse.EIO
 	}
 	return fuse.OK
 }
@@ -161,21 +373,31 @@ func (f *FileSystem) Rename(oldName string, newName string, context *fuse.Contex
 func (f *FileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
 	f.logger.Debug("Mkdir", zap.String("name", name))
 
-	dir, status := f.getParent(name)
+	c := newCaller(context)
+	dir, status := f.getParent(name, c)
 	if status != fuse.OK {
 		return status
 	}
+	if !c.permits(dir.Meta, permWrite|permExec) {
+		return fuse.EACCES
+	}
+	if err := f.Sess.usage.reserveInode(); err != nil {
+		return errorStatus(err)
+	}
 
 	// Set
 	newKey := NewObjectKey()
 	dir.FileMeta[filepath.Base(name)] = newKey
+	defer f.Sess.metaCache.invalidatePath(name)
 
 	newDir := f.Sess.CreateDirectory(newKey, dir.Key, mode, context)
+	newDir.Meta.inheritACL(dir.Meta)
 
 	// Save
 	err := newDir.Save()
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
+		f.Sess.usage.add(0, -1)
 		return fuse.EIO
 	}
 	err = dir.Save()
@@ -191,20 +413,29 @@ func (f *FileSystem) Symlink(value string, linkName string, context *fuse.Contex
 		zap.String("value", value),
 		zap.String("linkName", linkName))
 
-	dir, status := f.getParent(linkName)
+	c := newCaller(context)
+	dir, status := f.getParent(linkName, c)
 	if status != fuse.OK {
 		return status
 	}
+	if !c.permits(dir.Meta, permWrite|permExec) {
+		return fuse.EACCES
+	}
+	if err := f.Sess.usage.reserveInode(); err != nil {
+		return errorStatus(err)
+	}
 
 	// Set
 	newKey := NewObjectKey()
 	dir.FileMeta[filepath.Base(linkName)] = newKey
+	defer f.Sess.metaCache.invalidatePath(linkName)
 	symlink := f.Sess.CreateSymLink(newKey, dir.Key, value, context)
 
 	// Save
 	err := symlink.Save()
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
+		f.Sess.usage.add(0, -1)
 		return fuse.EIO
 	}
 	err = dir.Save()
@@ -223,20 +454,30 @@ func (f *FileSystem) Create(name string, flags uint32, mode uint32, context *fus
 		zap.Uint32("mode", mode),
 	)
 
-	dir, status := f.getParent(name)
+	c := newCaller(context)
+	dir, status := f.getParent(name, c)
 	if status != fuse.OK {
 		return nil, status
 	}
+	if !c.permits(dir.Meta, permWrite|permExec) {
+		return nil, fuse.EACCES
+	}
+	if err := f.Sess.usage.reserveInode(); err != nil {
+		return nil, errorStatus(err)
+	}
 
 	// Set
 	newKey := NewObjectKey()
 	dir.FileMeta[filepath.Base(name)] = newKey
+	defer f.Sess.metaCache.invalidatePath(name)
 
 	file := f.Sess.CreateFile(newKey, dir.Key, mode, context)
+	file.Meta.inheritACL(dir.Meta)
 
 	err := file.Save()
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
+		f.Sess.usage.add(0, -1)
 		return nil, fuse.EIO
 	}
 	err = dir.Save()
@@ -244,21 +485,26 @@ func (f *FileSystem) Create(name string, flags uint32, mode uint32, context *fus
 		f.logger.Debug("fuse error", zap.Error(err))
 		return nil, fuse.EIO
 	}
-	return NewOpenedFile(file), fuse.OK
+	opened := NewOpenedFile(file)
+	f.Sess.handles.add(opened)
+	return opened, fuse.OK
 }
 
 func (f *FileSystem) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
 	f.logger.Debug("OpenDir", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
-	if err != nil {
-		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return nil, status
 	}
 
 	dir, err := f.Sess.NewDirectory(key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return nil, fuse.ENOENT
+		return nil, errorStatus(err)
+	}
+	if !c.permits(dir.Meta, permRead) {
+		return nil, fuse.EACCES
 	}
 
 	stream = make([]fuse.DirEntry, 0)
@@ -276,117 +522,135 @@ func (f *FileSystem) OnMount(nodeFs *pathfs.PathNodeFs) {
 }
 
 func (f *FileSystem) OnUnmount() {
-	f.logger.Debug("Unmount")
+	stats := f.Sess.storage.CacheStats()
+	f.logger.Info("Unmount",
+		zap.Uint64("cache hits", stats.Hits),
+		zap.Uint64("cache misses", stats.Misses),
+		zap.Uint64("cache evictions", stats.Evictions))
 }
 
 func (f *FileSystem) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Chmod", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
-	if err != nil {
-		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return status
 	}
 
 	node, err := f.Sess.NewTypedNode(key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return errorStatus(err)
 	}
 
 	switch typed := node.(type) {
 	case *Directory:
-		typed.Meta.Mode = (typed.Meta.Mode & syscall.S_IFMT) | mode
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		typed.Meta.Mode, status = c.chmod(typed.Meta, mode)
+		if status == fuse.OK {
+			typed.Meta.syncACL()
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
 	case *File:
-		typed.Meta.Mode = (typed.Meta.Mode & syscall.S_IFMT) | mode
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		typed.Meta.Mode, status = c.chmod(typed.Meta, mode)
+		if status == fuse.OK {
+			typed.Meta.syncACL()
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
 	case *SymLink:
-		typed.Meta.Mode = (typed.Meta.Mode & syscall.S_IFMT) | mode
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		typed.Meta.Mode, status = c.chmod(typed.Meta, mode)
+		if status == fuse.OK {
+			typed.Meta.syncACL()
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
 	}
 	if err != nil {
 		return fuse.EIO
 	}
-	return fuse.OK
+	return status
 }
 
 func (f *FileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Chown", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
-	if err != nil {
-		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return status
 	}
 
 	node, err := f.Sess.NewTypedNode(key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return errorStatus(err)
 	}
 
 	switch typed := node.(type) {
 	case *Directory:
-		typed.Meta.UID = uid
-		typed.Meta.GID = gid
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		status = c.chown(&typed.Meta, uid, gid)
+		if status == fuse.OK {
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
 	case *File:
-		typed.Meta.UID = uid
-		typed.Meta.GID = gid
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		status = c.chown(&typed.Meta, uid, gid)
+		if status == fuse.OK {
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
 	case *SymLink:
-		typed.Meta.UID = uid
-		typed.Meta.GID = gid
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		status = c.chown(&typed.Meta, uid, gid)
+		if status == fuse.OK {
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
 	}
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
 		return fuse.EIO
 	}
-	return fuse.OK
+	return status
 }
 
 func (f *FileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Utimens", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
-	if err != nil {
-		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return status
 	}
 
 	node, err := f.Sess.NewTypedNode(key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return errorStatus(err)
 	}
 
 	switch typed := node.(type) {
 	case *Directory:
-		typed.Meta.Atime = *Atime
-		typed.Meta.Mtime = *Mtime
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		status = c.utimens(&typed.Meta, Atime, Mtime)
+		if status == fuse.OK {
+			err = typed.Save()
+		}
 	case *File:
-		typed.Meta.Atime = *Atime
-		typed.Meta.Mtime = *Mtime
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		status = c.utimens(&typed.Meta, Atime, Mtime)
+		if status == fuse.OK {
+			err = typed.Save()
+			for _, h := range f.Sess.handles.get(key) {
+				h.setTimes(typed.Meta)
+			}
+		}
 	case *SymLink:
-		typed.Meta.Atime = *Atime
-		typed.Meta.Mtime = *Mtime
-		typed.Meta.Ctime = time.Now()
-		err = typed.Save()
+		status = c.utimens(&typed.Meta, Atime, Mtime)
+		if status == fuse.OK {
+			err = typed.Save()
+		}
 	}
 	if err != nil {
 		return fuse.EIO
 	}
-	return fuse.OK
-
+	return status
 }
 
 func (f *FileSystem) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
@@ -395,34 +659,60 @@ func (f *FileSystem) Access(name string, mode uint32, context *fuse.Context) (co
 		zap.Uint32("mode", mode),
 	)
 
-	key, err := f.Sess.PathWalk(name)
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return status
+	}
+
+	meta, err := f.Sess.NodeMeta(key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return errorStatus(err)
 	}
-
-	if f.Sess.s3.IsExist(key) {
-		return fuse.OK
+	if !c.permits(meta, mode&7) {
+		return fuse.EACCES
 	}
-	f.logger.Debug("fuse error", zap.Error(err))
-	return fuse.ENOENT
+	return fuse.OK
 }
 
 func (f *FileSystem) Truncate(name string, size uint64, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Truncate", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
-	if err != nil {
-		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+	c := newCaller(context)
+	if f.onHandle(context) {
+		c = &caller{} // ftruncate(2), as root
+	}
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return status
 	}
 
 	node, err := f.Sess.NewFile(key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return fuse.ENOENT
+		return errorStatus(err)
+	}
+	if !c.permits(node.Meta, permWrite) {
+		return fuse.EACCES
+	}
+	defer node.release()
+
+	// Opened files have unsaved writes, they are truncated and saved later.
+	if handles := f.Sess.handles.get(key); len(handles) > 0 {
+		for _, h := range handles {
+			status := h.truncate(size)
+			if !status.Ok() {
+				return status
+			}
+		}
+		return fuse.OK
 	}
 
-	node.Meta.Size = int64(size)
+	err = node.Truncate(int64(size))
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return errorStatus(err)
+	}
 	err = node.Save()
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
@@ -433,33 +723,53 @@ func (f *FileSystem) Truncate(name string, size uint64, context *fuse.Context) (
 
 func (f *FileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
 	f.logger.Debug("Readlink", zap.String("name", name))
-	key, err := f.Sess.PathWalk(name)
-	if err != nil {
-		f.logger.Debug("fuse error", zap.Error(err))
-		return "", fuse.ENOENT
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return "", status
 	}
 
 	node, err := f.Sess.NewSymLink(key)
 	if err != nil {
 		f.logger.Debug("fuse error", zap.Error(err))
-		return "", fuse.ENOENT
+		return "", errorStatus(err)
 	}
 
 	return node.LinkTo, fuse.OK
 }
 
 func (f *FileSystem) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	f.logger.Debug("Rmdir", zap.String("name", name))
+	key, status := f.walk(name, newCaller(context))
+	if status != fuse.OK {
+		return status
+	}
+	if status := f.checkEmpty(key); status != fuse.OK {
+		return status
+	}
 	return f.Unlink(name, context)
 }
 
 func (f *FileSystem) Unlink(name string, context *fuse.Context) (code fuse.Status) {
 	f.logger.Debug("Unlink", zap.String("name", name))
-	dir, status := f.getParent(name)
+	c := newCaller(context)
+	dir, status := f.getParent(name, c)
 	if status != fuse.OK {
 		return status
 	}
+	if !c.permits(dir.Meta, permWrite|permExec) {
+		return fuse.EACCES
+	}
 
+	key, ok := dir.FileMeta[filepath.Base(name)]
+	if !ok {
+		return fuse.ENOENT
+	}
+	if status := f.checkSticky(dir, key, c); status != fuse.OK {
+		return status
+	}
 	delete(dir.FileMeta, filepath.Base(name))
+	defer f.Sess.metaCache.invalidatePath(name)
 
 	err := dir.Save()
 	if err != nil {
@@ -467,34 +777,303 @@ func (f *FileSystem) Unlink(name string, context *fuse.Context) (code fuse.Statu
 		return fuse.EIO
 	}
 
+	return f.unlinkNode(key)
+}
+
+func (f *FileSystem) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	f.logger.Debug("Link", zap.String("oldName", oldName), zap.String("newName", newName))
+
+	c := newCaller(context)
+	key, status := f.walk(oldName, c)
+	if status != fuse.OK {
+		return status
+	}
+
+	dir, status := f.getParent(newName, c)
+	if status != fuse.OK {
+		return status
+	}
+	if !c.permits(dir.Meta, permWrite|permExec) {
+		return fuse.EACCES
+	}
+	if _, ok := dir.FileMeta[filepath.Base(newName)]; ok {
+		return fuse.Status(syscall.EEXIST)
+	}
+
+	node, err := f.Sess.NewTypedNode(key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return errorStatus(err)
+	}
+
+	// The node is saved first, the count can only be larger than entries.
+	switch typed := node.(type) {
+	case *Directory:
+		return fuse.EPERM
+	case *File:
+		typed.Meta.Nlink = typed.Meta.Links() + 1
+		typed.Meta.Ctime = time.Now()
+		err = typed.Save()
+	case *SymLink:
+		typed.Meta.Nlink = typed.Meta.Links() + 1
+		typed.Meta.Ctime = time.Now()
+		err = typed.Save()
+	}
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return fuse.EIO
+	}
+
+	// Set
+	dir.FileMeta[filepath.Base(newName)] = key
+	defer f.Sess.metaCache.invalidatePath(newName)
+
+	err = dir.Save()
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return fuse.EIO
+	}
 	return fuse.OK
 }
 
+// Capacity reported by StatFs without quota
+const (
+	statfsBlockSize = 4096
+	unlimitedBytes  = 1 << 50 // 1 PiB
+	unlimitedInodes = 1 << 32
+)
+
+// StatFs reports usage counters of the superblock, free space is the rest
+// of the quota.
+func (f *FileSystem) StatFs(name string) *fuse.StatfsOut {
+	f.logger.Debug("StatFs", zap.String("name", name))
+	usage := f.Sess.usage
+	bytes, inodes := usage.usage()
+
+	totalBytes := usage.quotaBytes
+	if totalBytes <= 0 {
+		totalBytes = bytes + unlimitedBytes
+	}
+	totalInodes := usage.quotaInodes
+	if totalInodes <= 0 {
+		totalInodes = inodes + unlimitedInodes
+	}
+	used := (bytes + statfsBlockSize - 1) / statfsBlockSize
+	blocks := totalBytes / statfsBlockSize
+	if blocks < used {
+		blocks = used
+	}
+	if totalInodes < inodes {
+		totalInodes = inodes
+	}
+
+	return &fuse.StatfsOut{
+		Blocks:  uint64(blocks),
+		Bfree:   uint64(blocks - used),
+		Bavail:  uint64(blocks - used),
+		Files:   uint64(totalInodes),
+		Ffree:   uint64(totalInodes - inodes),
+		Bsize:   statfsBlockSize,
+		NameLen: 255,
+		Frsize:  statfsBlockSize,
+	}
+}
+
 func (f *FileSystem) String() string {
 	return "bucketsync"
 }
 
+func (f *FileSystem) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
+	f.logger.Debug("GetXAttr", zap.String("name", name), zap.String("attribute", attribute))
+	status := checkXAttrName(attribute, context)
+	if status == fuse.EPERM {
+		// trusted.* is invisible to users
+		return nil, fuse.ENODATA
+	}
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	meta, err := f.Sess.NodeMeta(key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, errorStatus(err)
+	}
+
+	if status := c.xattrPermits(meta, attribute, false); status != fuse.OK {
+		return nil, status
+	}
+	x, ok := meta.XAttrs[attribute]
+	if !ok {
+		return nil, fuse.ENODATA
+	}
+	data, err = f.Sess.xattrValue(x)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, errorStatus(err)
+	}
+	return data, fuse.OK
+}
+
+func (f *FileSystem) ListXAttr(name string, context *fuse.Context) (attributes []string, code fuse.Status) {
+	f.logger.Debug("ListXAttr", zap.String("name", name))
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	meta, err := f.Sess.NodeMeta(key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return nil, errorStatus(err)
+	}
+	return meta.xattrNames(context), fuse.OK
+}
+
+func (f *FileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	f.logger.Debug("RemoveXAttr", zap.String("name", name), zap.String("attr", attr))
+	status := checkXAttrName(attr, context)
+	if status != fuse.OK {
+		return status
+	}
+
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return status
+	}
+
+	node, err := f.Sess.NewTypedNode(key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return errorStatus(err)
+	}
+
+	remove := func(meta *Meta) fuse.Status {
+		isACL := attr == aclAccessName || attr == aclDefaultName
+		if isACL && !c.owns(*meta) {
+			return fuse.EPERM
+		}
+		if status := c.xattrPermits(*meta, attr, true); status != fuse.OK {
+			return status
+		}
+		return meta.removeXAttr(attr)
+	}
+
+	switch typed := node.(type) {
+	case *Directory:
+		status = remove(&typed.Meta)
+		if status == fuse.OK {
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
+	case *File:
+		status = remove(&typed.Meta)
+		if status == fuse.OK {
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
+	case *SymLink:
+		status = remove(&typed.Meta)
+		if status == fuse.OK {
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
+	}
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return fuse.EIO
+	}
+	return status
+}
+
+func (f *FileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	f.logger.Debug("SetXAttr", zap.String("name", name), zap.String("attr", attr), zap.Int("size", len(data)))
+	status := checkXAttrName(attr, context)
+	if status != fuse.OK {
+		return status
+	}
+	if len(data) > xattrSizeMax {
+		return fuse.Status(syscall.E2BIG)
+	}
+
+	c := newCaller(context)
+	key, status := f.walk(name, c)
+	if status != fuse.OK {
+		return status
+	}
+
+	node, err := f.Sess.NewTypedNode(key)
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return errorStatus(err)
+	}
+
+	// ACLs are small, they are always stored in Meta.
+	isACL := attr == aclAccessName || attr == aclDefaultName
+	set := func(meta *Meta) fuse.Status {
+		if isACL {
+			return meta.setACL(attr, data, flags, context)
+		}
+		if status := c.xattrPermits(*meta, attr, true); status != fuse.OK {
+			return status
+		}
+		// Large value is uploaded only if it can be set
+		if status := meta.checkXAttrFlags(attr, flags); status != fuse.OK {
+			return status
+		}
+		x, err := f.Sess.newXAttr(data)
+		if err != nil {
+			f.logger.Debug("fuse error", zap.Error(err))
+			return fuse.EIO
+		}
+		return meta.setXAttr(attr, x, flags)
+	}
+
+	switch typed := node.(type) {
+	case *Directory:
+		status = set(&typed.Meta)
+		if status == fuse.OK {
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
+	case *File:
+		status = set(&typed.Meta)
+		if status == fuse.OK {
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
+	case *SymLink:
+		// Same as Linux, user.* is only for files and directories
+		if strings.HasPrefix(attr, "user.") {
+			return fuse.EPERM
+		}
+		if isACL {
+			return fuse.Status(syscall.EOPNOTSUPP)
+		}
+		status = set(&typed.Meta)
+		if status == fuse.OK {
+			typed.Meta.Ctime = time.Now()
+			err = typed.Save()
+		}
+	}
+	if err != nil {
+		f.logger.Debug("fuse error", zap.Error(err))
+		return fuse.EIO
+	}
+	return status
+}
+
 // // TODO
-// func (f *FileSystem) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
-// 	return nil, fuse.OK
-// }
-// func (f *FileSystem) ListXAttr(name string, context *fuse.Context) (attributes []string, code fuse.Status) {
-// 	return nil, fuse.OK
-// }
-// func (f *FileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-// 	return fuse.OK
-// }
-// func (f *FileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-// 	return fuse.OK
-// }
-// func (f *FileSystem) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
-// 	return fuse.OK
-// }
 // func (f *FileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
 // 	return fuse.OK
 // }
-// func (f *FileSystem) StatFs(name string) *fuse.StatfsOut {
-// 	return nil
-// }
 // func (f *FileSystem) SetDebug(debug bool) {
 // }
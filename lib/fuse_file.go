@@ -1,9 +1,7 @@
 package bucketsync
 
 import (
-	"bytes"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -17,6 +15,57 @@ type OpenedFile struct {
 	file  *File
 	dirty bool
 	open  bool
+	log   *journalLog // nil if journal is disabled
+
+	handles *openedFiles // nil if it's not a FUSE handle
+
+	// sequential read detection, reads may be concurrent
+	raLock     sync.Mutex
+	nextRead   int64
+	window     int64
+	prefetched int64
+}
+
+// openedFiles is FUSE handles by key. Truncate and utimens by path are
+// applied to them, so that saving a handle doesn't revert the change.
+type openedFiles struct {
+	lock  sync.Mutex
+	files map[ObjectKey]map[*OpenedFile]struct{}
+}
+
+func newOpenedFiles() *openedFiles {
+	return &openedFiles{files: make(map[ObjectKey]map[*OpenedFile]struct{})}
+}
+
+func (o *openedFiles) add(f *OpenedFile) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	key := f.file.Key
+	if o.files[key] == nil {
+		o.files[key] = make(map[*OpenedFile]struct{})
+	}
+	o.files[key][f] = struct{}{}
+	f.handles = o
+}
+
+func (o *openedFiles) remove(f *OpenedFile) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	key := f.file.Key
+	delete(o.files[key], f)
+	if len(o.files[key]) == 0 {
+		delete(o.files, key)
+	}
+}
+
+func (o *openedFiles) get(key ObjectKey) []*OpenedFile {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	files := make([]*OpenedFile, 0, len(o.files[key]))
+	for f := range o.files[key] {
+		files = append(files, f)
+	}
+	return files
 }
 
 func NewOpenedFile(file *File) *OpenedFile {
@@ -25,14 +74,33 @@ func NewOpenedFile(file *File) *OpenedFile {
 		file:  file,
 		dirty: false,
 		open:  true,
+		log:   file.sess.journal.Open(file.Key),
+	}
+}
+
+// save saves the file, and removes the journal of saved writes
+func (f *OpenedFile) save() error {
+	if !f.dirty {
+		return nil
 	}
+	err := f.file.mergeMeta()
+	if err != nil {
+		f.file.sess.logger.Error("Save failed", zap.Error(err))
+		return err
+	}
+	err = f.file.Save()
+	if err != nil {
+		f.file.sess.logger.Error("Save failed", zap.Error(err))
+		return err
+	}
+	f.dirty = false
+	return f.log.Commit()
 }
 
 func (f *OpenedFile) Flush() fuse.Status {
 	f.file.sess.logger.Debug("Flush")
-	if f.dirty {
-		f.file.Save()
-		f.dirty = false
+	if f.save() != nil {
+		return fuse.EIO
 	}
 	return fuse.OK
 }
@@ -43,71 +111,71 @@ func (f *OpenedFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status)
 	if off > f.file.Meta.Size {
 		return nil, fuse.ENODATA
 	}
+	f.readahead(off, int64(len(dest)))
+
+	if f.file.Chunking == ChunkingCDC {
+		n, err := f.file.readChunks(dest, off)
+		if err != nil {
+			return nil, fuse.EIO
+		}
+		return &ReadResult{content: dest[:n], size: n}, fuse.OK
+	}
 
-	// Calculate Extent index, offset
+	// Calculate Extent index
 	// example: ExtentSize = 3, off = 8, len(dest) = 8
 	//        ---|---|--=|===|===|=--|---
 	// offset:012 345 678 901 234 567 890
 	// index:  0   1   2   3   4   5   6
-	//        012 012 012 012 012 012 012
-	// firstIndex = 2, lastIndex = 5
-	// startOffset = 2 endOffset = 0
+	// first = 2, last = 5
 	first := off / f.file.ExtentSize
-	last := (int64(len(dest)) + off) / f.file.ExtentSize
-
-	startOffset := off - (first)*f.file.ExtentSize
-	endOffset := (int64(len(dest)) + off) - last*f.file.ExtentSize - 1
+	last := (int64(len(dest)) + off - 1) / f.file.ExtentSize
 
 	f.file.sess.logger.Debug("Read params", zap.Int64("first", first),
-		zap.Int64("last", last),
-		zap.Int64("startOffset", startOffset),
-		zap.Int64("endOffset", endOffset))
+		zap.Int64("last", last))
 
-	// Get extents concurrently
-	extentBytes := make([][]byte, last-first+1)
+	for i := range dest {
+		dest[i] = 0
+	}
 
+	// Get extents concurrently
 	var wg sync.WaitGroup
-	errc := make(chan error)
-	done := make(chan struct{})
+	errc := make(chan error, last-first+1)
 	for i := first; i <= last; i++ {
+		extent, ok := f.file.Extent[i]
+		if !ok {
+			// No extent means sparce area, fill zero.
+			continue
+		}
+		// Copy overlapped area
+		start := off - i*f.file.ExtentSize
+		destStart := int64(0)
+		if start < 0 {
+			destStart = -start
+			start = 0
+		}
+		destEnd := destStart + f.file.ExtentSize - start
+		if destEnd > int64(len(dest)) {
+			destEnd = int64(len(dest))
+		}
+
 		f.file.sess.logger.Debug("Download thread started", zap.Int64("num", i))
 		wg.Add(1)
-		go func(i int64) {
-			bytesIndex := i - first
-
-			extent, ok := f.file.Extent[i]
-			if !ok {
-				// No extent means sparce area, fill zero.
-				extentBytes[bytesIndex] = make([]byte, f.file.ExtentSize)
-				wg.Done()
-				return
-			}
-			err := extent.Fill()
+		go func(e *Extent, d []byte, start int64) {
+			defer wg.Done()
+			err := e.ReadAt(d, start, f.file.ExtentSize)
 			if err != nil {
-				f.file.sess.logger.Error("Fill failed")
+				f.file.sess.logger.Error("ReadAt failed", zap.Error(err))
 				errc <- err
 			}
-			extentBytes[bytesIndex] = extent.body
-			wg.Done()
-		}(i)
+		}(extent, dest[destStart:destEnd], start)
 	}
-	go func() {
-		wg.Wait()
-		f.file.sess.logger.Debug("All download threads done")
-		close(done)
-	}()
+	wg.Wait()
+	f.file.sess.logger.Debug("All download threads done")
 
 	select {
 	case <-errc:
 		return nil, fuse.EIO
-	case <-done:
-		// Trim
-		extentBytes[0] = extentBytes[0][startOffset:len(extentBytes[0])]
-		content := bytes.Join(extentBytes, []byte{})
-		copy(dest, content)
-
-		f.file.sess.logger.Debug("wait done", zap.Int("content len", len(content)),
-			zap.Int("dest len", len(dest)))
+	default:
 		return &ReadResult{content: dest, size: len(dest)}, fuse.OK
 	}
 }
@@ -115,8 +183,35 @@ func (f *OpenedFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status)
 func (f *OpenedFile) Write(data []byte, off int64) (written uint32, code fuse.Status) {
 	f.file.sess.logger.Debug("Write", zap.Int("datalen", len(data)),
 		zap.Int64("offset", off))
+
+	if end := off + int64(len(data)); end > f.file.Meta.Size {
+		err := f.file.reserve(end)
+		if err != nil {
+			f.file.sess.logger.Debug("Write failed", zap.Error(err))
+			return 0, errorStatus(err)
+		}
+	}
+
+	// Write-ahead, written data survives crash after it's acknowledged.
+	err := f.log.Write(off, data)
+	if err != nil {
+		f.file.sess.logger.Error("Journal write failed", zap.Error(err))
+		return 0, fuse.EIO
+	}
 	f.dirty = true
 
+	if f.file.Chunking == ChunkingCDC {
+		err = f.file.writeChunks(data, off)
+		if err != nil {
+			f.file.sess.logger.Error("Write failed", zap.Error(err))
+			return 0, fuse.EIO
+		}
+		if f.file.Meta.Size < off+int64(len(data)) {
+			f.file.Meta.Size = off + int64(len(data))
+		}
+		return uint32(len(data)), fuse.OK
+	}
+
 	first := off / f.file.ExtentSize
 	startOffset := off - (first)*f.file.ExtentSize
 	pos := 0
@@ -157,18 +252,24 @@ func (f *OpenedFile) Write(data []byte, off int64) (written uint32, code fuse.St
 
 func (f *OpenedFile) Release() {
 	f.file.sess.logger.Debug("Release")
-	if f.dirty {
-		f.file.Save()
-		f.dirty = false
-	}
+	f.save()
+	f.file.release() // if save failed
 	f.open = false
+	if f.handles != nil {
+		f.handles.remove(f)
+	}
 }
 
 func (f *OpenedFile) Fsync(flags int) (code fuse.Status) {
 	f.file.sess.logger.Debug("Fsync")
-	if f.dirty {
-		f.file.Save()
-		f.dirty = false
+	if f.save() != nil {
+		return fuse.EIO
+	}
+	// Wait for durability in write-back mode
+	err := f.file.sess.storage.Sync(f.file.Key)
+	if err != nil {
+		f.file.sess.logger.Error("Fsync failed", zap.Error(err))
+		return fuse.EIO
 	}
 	return fuse.OK
 }
@@ -177,12 +278,37 @@ func (f *OpenedFile) String() string {
 	return f.file.Key
 }
 
+// Truncate falls back to FileSystem.Truncate, which checks the caller.
+// pathfs calls it also for truncate(2) by path, without the caller.
 func (f *OpenedFile) Truncate(size uint64) fuse.Status {
+	return fuse.ENOSYS
+}
+
+// truncate truncates the opened file, it's saved later with writes
+func (f *OpenedFile) truncate(size uint64) fuse.Status {
 	f.file.sess.logger.Debug("Truncate", zap.Uint64("size", size))
 	if !f.open {
 		return fuse.EBADF
 	}
-	f.file.Meta.Size = int64(size)
+
+	err := f.file.reserve(int64(size))
+	if err != nil {
+		f.file.sess.logger.Debug("Truncate failed", zap.Error(err))
+		return errorStatus(err)
+	}
+
+	err = f.log.Truncate(int64(size))
+	if err != nil {
+		f.file.sess.logger.Error("Journal write failed", zap.Error(err))
+		return fuse.EIO
+	}
+	f.dirty = true
+
+	err = f.file.Truncate(int64(size))
+	if err != nil {
+		f.file.sess.logger.Error("Truncate failed", zap.Error(err))
+		return errorStatus(err)
+	}
 	return fuse.OK
 }
 
@@ -195,7 +321,7 @@ func (f *OpenedFile) GetAttr(out *fuse.Attr) fuse.Status {
 	out.Ino = InodeHash(f.file.Key)
 	out.Size = uint64(f.file.Meta.Size)
 	out.Mode = f.file.Meta.Mode
-	out.Nlink = 1
+	out.Nlink = f.file.Meta.Links()
 	out.Owner = fuse.Owner{
 		Uid: f.file.Meta.UID,
 		Gid: f.file.Meta.GID,
@@ -204,36 +330,16 @@ func (f *OpenedFile) GetAttr(out *fuse.Attr) fuse.Status {
 	return fuse.OK
 }
 
-func (f *OpenedFile) Chown(uid uint32, gid uint32) fuse.Status {
-	f.file.sess.logger.Debug("Chown")
-	if !f.open {
-		return fuse.EBADF
-	}
-	f.file.Meta.UID = uid
-	f.file.Meta.GID = gid
-	f.file.Meta.Ctime = time.Now()
-	return fuse.OK
-}
-
-func (f *OpenedFile) Chmod(perms uint32) fuse.Status {
-	f.file.sess.logger.Debug("Chmod")
-	if !f.open {
-		return fuse.EBADF
-	}
-	f.file.Meta.Mode = (f.file.Meta.Mode & syscall.S_IFMT) | perms
-	f.file.Meta.Ctime = time.Now()
-	return fuse.OK
+// Utimens falls back to FileSystem.Utimens, same as Truncate
+func (f *OpenedFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return fuse.ENOSYS
 }
 
-func (f *OpenedFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
-	f.file.sess.logger.Debug("Utimens")
-	if !f.open {
-		return fuse.EBADF
-	}
-	f.file.Meta.Atime = *atime
-	f.file.Meta.Mtime = *mtime
-	f.file.Meta.Ctime = time.Now()
-	return fuse.OK
+// setTimes copies timestamps changed by path
+func (f *OpenedFile) setTimes(meta Meta) {
+	f.file.Meta.Atime = meta.Atime
+	f.file.Meta.Mtime = meta.Mtime
+	f.file.Meta.Ctime = meta.Ctime
 }
 
 func (f *OpenedFile) Allocate(off uint64, size uint64, mode uint32) (code fuse.Status) {
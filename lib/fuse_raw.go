@@ -0,0 +1,33 @@
+package bucketsync
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// rawFileSystem tells FileSystem which requests are made on a file handle.
+// pathfs truncates by path even for ftruncate(2), and the caller of
+// ftruncate must not be checked again: write is permitted by open(2).
+type rawFileSystem struct {
+	fuse.RawFileSystem
+	fs *FileSystem
+}
+
+// NewRawFileSystem wraps raw, the connector which serves fs.
+func NewRawFileSystem(raw fuse.RawFileSystem, fs *FileSystem) fuse.RawFileSystem {
+	return &rawFileSystem{RawFileSystem: raw, fs: fs}
+}
+
+// SetAttr marks the context, it's passed to FileSystem.Truncate as it is.
+func (r *rawFileSystem) SetAttr(input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if input.Valid&fuse.FATTR_FH != 0 {
+		r.fs.handleCalls.Store(&input.Context, struct{}{})
+		defer r.fs.handleCalls.Delete(&input.Context)
+	}
+	return r.RawFileSystem.SetAttr(input, out)
+}
+
+// onHandle returns true if the request is made on a file handle
+func (f *FileSystem) onHandle(context *fuse.Context) bool {
+	_, ok := f.handleCalls.Load(context)
+	return ok
+}
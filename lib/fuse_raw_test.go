@@ -0,0 +1,63 @@
+package bucketsync
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+func TestFtruncateReadOnlyMode(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	fs := mountTestFS(t, config)
+	defer fs.Close()
+	if status := fs.Mkdir("tmp", 01777, &fuse.Context{}); status != fuse.OK {
+		t.Fatal(status)
+	}
+	conn := nodefs.NewFileSystemConnector(pathfs.NewPathNodeFs(fs, nil).Root(), nil)
+	raw := NewRawFileSystem(conn.RawFS(), fs)
+	user := fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}
+
+	dir := fuse.EntryOut{}
+	header := fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID, Context: user}
+	if status := raw.Lookup(&header, "tmp", &dir); status != fuse.OK {
+		t.Fatal(status)
+	}
+	// open(O_CREAT|O_WRONLY, 0444)
+	created := fuse.CreateOut{}
+	create := &fuse.CreateIn{
+		InHeader: fuse.InHeader{NodeId: dir.NodeId, Context: user},
+		Flags:    uint32(os.O_CREATE | os.O_WRONLY),
+		Mode:     0444,
+	}
+	if status := raw.Create(create, "file", &created); status != fuse.OK {
+		t.Fatal(status)
+	}
+
+	setAttr := func(valid uint32) fuse.Status {
+		in := &fuse.SetAttrIn{}
+		in.NodeId = created.NodeId
+		in.Context = user
+		in.Valid = valid
+		in.Fh = created.Fh
+		in.Size = 10
+		return raw.SetAttr(in, &fuse.AttrOut{})
+	}
+	// truncate(2) is checked against the mode, ftruncate(2) is not
+	if status := setAttr(fuse.FATTR_SIZE); status != fuse.EACCES {
+		t.Fatalf("truncate: %v", status)
+	}
+	if status := setAttr(fuse.FATTR_SIZE | fuse.FATTR_FH); status != fuse.OK {
+		t.Fatalf("ftruncate: %v", status)
+	}
+
+	release := &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: created.NodeId, Context: user}, Fh: created.Fh}
+	raw.Release(release)
+	if attr, status := fs.GetAttr("tmp/file", testContext); status != fuse.OK || attr.Size != 10 {
+		t.Fatalf("size = %d, %v", attr.Size, status)
+	}
+}
@@ -0,0 +1,254 @@
+package bucketsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// GCReport is the result of garbage collection
+type GCReport struct {
+	Reachable int   // objects referenced from the root
+	Garbage   int   // unreferenced objects older than grace period
+	Bytes     int64 // size of Garbage
+	Recent    int   // unreferenced objects within grace period
+	Deleted   int
+	Unknown   int // objects named like old extents, but never seen referenced
+
+	AbortedUploads int // incomplete uploads older than grace period
+
+	// Packing mode
+	DeadPacks int // packs without live objects, or without index
+	Repacked  int // packs rewritten, most of objects were dead
+}
+
+// Object keys written by bucketsync, UUID for nodes and hash for extents.
+// Other objects in the bucket are never deleted.
+var objectKeyPattern = regexp.MustCompile(`^([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|[0-9a-f]{64})$`)
+
+// Extents written by older versions are named by murmur3, but short hex
+// names may be anything in a shared bucket. They are deleted only if gc
+// saw them referenced before, such keys are kept in legacyExtentsKey.
+var legacyKeyPattern = regexp.MustCompile(`^[0-9a-f]{1,16}$`)
+
+const legacyExtentsKey = "bucketsync-gc-legacy-extents"
+
+// GC deletes objects which are not reachable from the root and older than
+// grace, and aborts incomplete uploads older than grace.
+// Objects are only reported if dryRun is true.
+// A deduplicated extent can be referenced again after the walk, writers
+// touch it so that it's within grace. GC should still not run while
+// another client is writing, the extent is deleted if it's touched after
+// the listing.
+func (s *Session) GC(grace time.Duration, dryRun bool) (*GCReport, error) {
+	reachable, err := s.reachableKeys()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to walk filesystem, nothing is deleted")
+	}
+
+	known, err := s.loadLegacyExtents()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load legacy extents, nothing is deleted")
+	}
+	// Referenced now, or referenced before and still stored
+	legacy := make(map[ObjectKey]struct{})
+	for key := range reachable {
+		if legacyKeyPattern.MatchString(key) {
+			legacy[key] = struct{}{}
+		}
+	}
+
+	report := &GCReport{Reachable: len(reachable)}
+	threshold := time.Now().Add(-grace)
+	garbage := make([]ObjectKey, 0)
+	packTimes := make(map[string]time.Time)
+	err = s.storage.List(func(info ObjectInfo) error {
+		if strings.HasPrefix(info.Key, packPrefix) {
+			packTimes[info.Key] = info.LastModified
+		}
+		if _, ok := reachable[info.Key]; ok {
+			return nil
+		}
+		if legacyKeyPattern.MatchString(info.Key) {
+			if _, ok := known[info.Key]; !ok {
+				report.Unknown++
+				return nil
+			}
+			legacy[info.Key] = struct{}{}
+		} else if !objectKeyPattern.MatchString(info.Key) {
+			return nil
+		}
+		if info.LastModified.After(threshold) {
+			report.Recent++
+			return nil
+		}
+		report.Garbage++
+		report.Bytes += info.Size
+		garbage = append(garbage, info.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.storage.packs != nil {
+		err = s.collectPacks(reachable, threshold, packTimes, dryRun, report)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	// Saved before deletion, the keys are deleted again by the next run
+	// if this run fails.
+	err = s.saveLegacyExtents(legacy)
+	if err != nil {
+		return report, err
+	}
+
+	for _, key := range garbage {
+		err := s.storage.Delete(key)
+		if err != nil {
+			return report, err
+		}
+		s.logger.Debug("GC deleted", zap.String("key", key))
+		report.Deleted++
+	}
+
+	report.AbortedUploads, err = s.storage.AbortStaleUploads(threshold)
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// collectPacks deletes packs without live objects, and rewrites packs
+// whose live objects are less than half. Packs with live metadata are not
+// rewritten. Packs without index are left by failed upload, they are also
+// deleted.
+func (s *Session) collectPacks(reachable map[ObjectKey]struct{}, threshold time.Time,
+	packTimes map[string]time.Time, dryRun bool, report *GCReport) error {
+	packs := s.storage.packs
+	usages := packs.usage(reachable)
+	indexed := make(map[string]bool)
+	for _, u := range usages {
+		indexed[u.pack] = true
+	}
+
+	for pack, modified := range packTimes {
+		if indexed[pack] || modified.After(threshold) {
+			continue
+		}
+		report.DeadPacks++
+		if dryRun {
+			continue
+		}
+		err := packs.ObjectStore.Delete(pack)
+		if err != nil {
+			return err
+		}
+		s.logger.Debug("GC deleted pack without index", zap.String("pack", pack))
+	}
+
+	for _, u := range usages {
+		modified, ok := packTimes[u.pack]
+		if !ok || modified.After(threshold) || u.bytes*2 >= u.total || u.meta > 0 {
+			continue
+		}
+		if len(u.live) == 0 {
+			report.DeadPacks++
+		} else {
+			report.Repacked++
+		}
+		if dryRun {
+			continue
+		}
+		err := packs.repack(u)
+		if err != nil {
+			return err
+		}
+		s.logger.Debug("GC collected pack", zap.String("pack", u.pack),
+			zap.Int("live", len(u.live)))
+	}
+	return nil
+}
+
+// loadLegacyExtents returns murmur3 keys which gc saw referenced
+func (s *Session) loadLegacyExtents() (map[ObjectKey]struct{}, error) {
+	known := make(map[ObjectKey]struct{})
+	data, err := s.storage.Download(legacyExtentsKey, kindMeta)
+	if errors.Cause(err) == ErrNotFound {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]ObjectKey, 0)
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, errors.Wrapf(ErrCorruptObject, "key = %s, %s", legacyExtentsKey, err)
+	}
+	for _, key := range keys {
+		known[key] = struct{}{}
+	}
+	return known, nil
+}
+
+func (s *Session) saveLegacyExtents(legacy map[ObjectKey]struct{}) error {
+	keys := make([]ObjectKey, 0, len(legacy))
+	for key := range legacy {
+		keys = append(keys, key)
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return s.storage.Upload(legacyExtentsKey, bytes.NewReader(data), kindMeta)
+}
+
+// reachableKeys walks the tree from the root, and returns all keys of
+// nodes and extents.
+func (s *Session) reachableKeys() (map[ObjectKey]struct{}, error) {
+	reachable := map[ObjectKey]struct{}{
+		bucketHeaderKey:  {},
+		superblockKey:    {},
+		legacyExtentsKey: {},
+	}
+	queue := []ObjectKey{s.RootKey()}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		if _, ok := reachable[key]; ok {
+			continue
+		}
+		reachable[key] = struct{}{}
+
+		node, err := s.NewTypedNode(key)
+		if err != nil {
+			return nil, err
+		}
+		switch typed := node.(type) {
+		case *Directory:
+			for _, child := range typed.FileMeta {
+				queue = append(queue, child)
+			}
+			typed.Meta.addXAttrKeys(reachable)
+		case *File:
+			for _, e := range typed.extents() {
+				reachable[e.Key] = struct{}{}
+			}
+			typed.Meta.addXAttrKeys(reachable)
+		case *SymLink:
+			typed.Meta.addXAttrKeys(reachable)
+		}
+	}
+	return reachable, nil
+}
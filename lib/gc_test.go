@@ -0,0 +1,164 @@
+package bucketsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestGCReachability(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	fs := mountTestFS(t, config)
+	random := rand.New(rand.NewSource(1))
+	kept := make([]byte, 3*config.ExtentSize)
+	random.Read(kept)
+	dropped := make([]byte, 3*config.ExtentSize)
+	random.Read(dropped)
+
+	if status := fs.Mkdir("dir", 0755, testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	writeTestFile(t, fs, "dir/kept", kept)
+	writeTestFile(t, fs, "copy", kept) // shares extents with dir/kept
+	writeTestFile(t, fs, "dropped", dropped)
+
+	key, err := fs.Sess.PathWalk("dropped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Sess.NewFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := []ObjectKey{}
+	for _, e := range file.extents() {
+		garbage = append(garbage, e.Key)
+	}
+	if status := fs.Unlink("dropped", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if status := fs.Unlink("copy", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+
+	// Other objects in the bucket
+	foreign := []string{"README.txt", "0123abcd"}
+	for _, name := range foreign {
+		err := ioutil.WriteFile(filepath.Join(config.LocalPath, name), []byte(name), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(key string) bool {
+		_, err := os.Stat(filepath.Join(config.LocalPath, key))
+		return err == nil
+	}
+
+	// Within grace period
+	report, err := fs.Sess.GC(time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 0 || report.Recent < len(garbage) {
+		t.Fatalf("%+v", report)
+	}
+
+	report, err = fs.Sess.GC(0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 0 || report.Garbage < len(garbage) || report.Unknown != 1 {
+		t.Fatalf("dry run: %+v", report)
+	}
+	for _, key := range garbage {
+		if !exists(key) {
+			t.Fatalf("%s is deleted by dry run", key)
+		}
+	}
+
+	report, err = fs.Sess.GC(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != report.Garbage || report.Deleted < len(garbage) {
+		t.Fatalf("%+v", report)
+	}
+	for _, key := range garbage {
+		if exists(key) {
+			t.Fatalf("%s is not deleted", key)
+		}
+	}
+	for _, name := range foreign {
+		if !exists(name) {
+			t.Fatalf("%s is deleted", name)
+		}
+	}
+
+	// Shared extents are reachable from the other link
+	fs.Close()
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	if got := readTestFile(t, fs, "dir/kept"); !bytes.Equal(got, kept) {
+		t.Fatal("reachable file is broken")
+	}
+	report, err = fs.Sess.GC(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Garbage != 0 {
+		t.Fatalf("second run: %+v", report)
+	}
+}
+
+func TestGCDeduplicatedExtent(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	fs := mountTestFS(t, config)
+	defer fs.Close()
+	data := make([]byte, 2*config.ExtentSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeTestFile(t, fs, "old", data)
+
+	key, err := fs.Sess.PathWalk("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Sess.NewFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := fs.Unlink("old", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	// Unreferenced for a day
+	past := time.Now().Add(-24 * time.Hour)
+	for _, e := range file.extents() {
+		err := os.Chtimes(filepath.Join(config.LocalPath, e.Key), past, past)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Written again, and unlinked as if gc walked before it's saved.
+	// The extent is within grace.
+	writeTestFile(t, fs, "new", data)
+	if status := fs.Unlink("new", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	report, err := fs.Sess.GC(time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Garbage != 0 || report.Recent < len(file.extents()) {
+		t.Fatalf("deduplicated extent is garbage: %+v", report)
+	}
+}
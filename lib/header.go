@@ -0,0 +1,219 @@
+package bucketsync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/spaolacci/murmur3"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/scrypt"
+)
+
+// bucketHeaderKey is the key of BucketHeader object.
+// It's stored in plaintext, because it's needed to derive the key.
+const bucketHeaderKey = "bucketsync-header"
+
+const (
+	kdfNone   = ""
+	kdfScrypt = "scrypt"
+)
+
+// Default scrypt parameters, recommended for interactive login in 2017.
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 32
+)
+
+var ErrWrongPassword = errors.New("password doesn't match bucket header")
+
+// BucketHeader is a bucket-level object, which holds the location of the
+// root directory and key derivation parameters.
+type BucketHeader struct {
+	Version  int       `json:"version"`
+	Root     ObjectKey `json:"root"`
+	KDF      string    `json:"kdf"`
+	Salt     []byte    `json:"salt,omitempty"`
+	N        int       `json:"n,omitempty"`
+	R        int       `json:"r,omitempty"`
+	P        int       `json:"p,omitempty"`
+	KeyCheck []byte    `json:"key_check,omitempty"`
+}
+
+// keys derived from password
+type keySet struct {
+	encryption  []byte
+	check       []byte
+	contentHash []byte
+}
+
+func newKeySet(master []byte) *keySet {
+	return &keySet{
+		encryption:  subKey(master, "encryption"),
+		check:       subKey(master, "key check"),
+		contentHash: subKey(master, "content hash"),
+	}
+}
+
+func subKey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func (h *BucketHeader) deriveKeys(password string) (*keySet, error) {
+	switch h.KDF {
+	case kdfScrypt:
+		master, err := scrypt.Key([]byte(password), h.Salt, h.N, h.R, h.P, 32)
+		if err != nil {
+			return nil, err
+		}
+		return newKeySet(master), nil
+	default:
+		return nil, errors.Errorf("unknown kdf %q", h.KDF)
+	}
+}
+
+// legacyKeys is for buckets created before BucketHeader was introduced,
+// the key is sha256(password) and the root key is murmur3(password).
+func legacyKeys(password string) *keySet {
+	key := sha256.Sum256([]byte(password))
+	return &keySet{
+		encryption:  key[:],
+		contentHash: subKey(key[:], "content hash"),
+	}
+}
+
+func legacyRootKey(password string) ObjectKey {
+	return fmt.Sprintf("%x", murmur3.Sum64([]byte(password)))
+}
+
+func newBucketHeader(encryption bool, password string) (*BucketHeader, *keySet, error) {
+	header := &BucketHeader{
+		Version: 1,
+		Root:    NewObjectKey(),
+		KDF:     kdfNone,
+	}
+	if !encryption {
+		return header, nil, nil
+	}
+
+	header.KDF = kdfScrypt
+	header.N = scryptN
+	header.R = scryptR
+	header.P = scryptP
+	header.Salt = make([]byte, scryptSaltLen)
+	_, err := io.ReadFull(rand.Reader, header.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := header.deriveKeys(password)
+	if err != nil {
+		return nil, nil, err
+	}
+	header.KeyCheck = keys.check
+	return header, keys, nil
+}
+
+// openBucket reads BucketHeader, or creates it for a new bucket.
+// It sets up cipher of Storage and returns the root key and derived keys,
+// keys is nil if encryption is disabled.
+func (s *Storage) openBucket(config *Config) (ObjectKey, *keySet, error) {
+	password, err := config.password()
+	if err != nil {
+		return "", nil, err
+	}
+	if config.Encryption && password == "" {
+		return "", nil, errors.New("password is required for encryption")
+	}
+
+	// Transient error must not be taken as a new bucket.
+	headerExists, err := s.backend.IsExist(bucketHeaderKey)
+	if err != nil {
+		return "", nil, err
+	}
+	legacyExists := false
+	if !headerExists {
+		legacyExists, err = s.backend.IsExist(legacyRootKey(password))
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	var keys *keySet
+	var header *BucketHeader
+	if headerExists {
+		header, err = s.loadBucketHeader()
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case header.KDF == kdfNone && config.Encryption:
+			return "", nil, errors.Wrap(ErrUnencryptedObject, "bucket header")
+		case header.KDF != kdfNone && !config.Encryption:
+			return "", nil, errors.Wrap(ErrEncryptedObject, "bucket header")
+		case header.KDF != kdfNone:
+			keys, err = header.deriveKeys(password)
+			if err != nil {
+				return "", nil, err
+			}
+			if !hmac.Equal(keys.check, header.KeyCheck) {
+				return "", nil, ErrWrongPassword
+			}
+		}
+	} else if legacyExists {
+		s.logger.Warn("bucket header is not found, use legacy key derivation")
+		if config.Encryption {
+			keys = legacyKeys(password)
+		}
+		header = &BucketHeader{Root: legacyRootKey(password)}
+	} else {
+		header, keys, err = newBucketHeader(config.Encryption, password)
+		if err != nil {
+			return "", nil, err
+		}
+		err = s.saveBucketHeader(header)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if keys != nil {
+		s.cipher, err = NewCipher(keys.encryption)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	s.logger.Debug("Bucket opened", zap.String("root", header.Root), zap.String("kdf", header.KDF))
+	return header.Root, keys, nil
+}
+
+func (s *Storage) loadBucketHeader() (*BucketHeader, error) {
+	data, err := s.backend.Download(bucketHeaderKey)
+	if err != nil {
+		return nil, err
+	}
+	header := &BucketHeader{}
+	err = json.Unmarshal(data, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "bucket header is broken")
+	}
+	return header, nil
+}
+
+func (s *Storage) saveBucketHeader(header *BucketHeader) error {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	return s.backend.Upload(bucketHeaderKey, bytes.NewReader(data))
+}
@@ -0,0 +1,30 @@
+package bucketsync
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenBucketPassword(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	mountTestFS(t, config).Close()
+
+	// Same password from a key file, trailing newline is ignored
+	keyFile := filepath.Join(filepath.Dir(config.LocalPath), "keyfile")
+	err := ioutil.WriteFile(keyFile, []byte(config.Password+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Password = ""
+	config.KeyFile = keyFile
+	mountTestFS(t, config).Close()
+
+	// Wrong password must not open the bucket
+	config.KeyFile = ""
+	config.Password = "wrong"
+	if _, err := NewSession(config); err == nil {
+		t.Fatal("bucket is opened with wrong password")
+	}
+}
@@ -0,0 +1,316 @@
+package bucketsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// journal is a local write-ahead log of file writes and truncates, which
+// are not saved yet. Each opened file has its own log, records are synced
+// before Write or Truncate returns, and the log is removed after File.Save.
+// Logs are replayed on the next mount, if the process died. The directory
+// is locked, another process using the same directory fails to start.
+//
+// Record: length(4) | crc32(4) | body
+// body is type(1) | offset(8) | data, encrypted if encryption is enabled.
+// offset of truncate record is the new size.
+type journal struct {
+	dir    string
+	lock   *os.File
+	cipher *Cipher
+	logger *Logger
+	seq    uint64
+}
+
+type journalLog struct {
+	journal *journal
+	key     ObjectKey
+	path    string
+	lock    sync.Mutex
+	file    *os.File
+}
+
+type journalRecord struct {
+	op     byte
+	offset int64
+	data   []byte
+}
+
+// Journal record types
+const (
+	journalWrite    byte = 1
+	journalTruncate byte = 2
+)
+
+func newJournal(config *Config, cipher *Cipher, logger *Logger) (*journal, error) {
+	if config.JournalDir == "" {
+		return nil, nil
+	}
+	err := os.MkdirAll(config.JournalDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(config.JournalDir)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{
+		dir:    config.JournalDir,
+		lock:   lock,
+		cipher: cipher,
+		logger: logger,
+		seq:    uint64(time.Now().UnixNano()),
+	}, nil
+}
+
+var ErrDirLocked = errors.New("directory is used by another process")
+
+// Lock file in journal and write-back directories
+const dirLockName = "lock"
+
+// lockDir takes exclusive lock of the directory, until the returned file
+// is closed. The lock is released when the process died.
+func lockDir(dir string) (*os.File, error) {
+	path := filepath.Join(dir, dirLockName)
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, errors.Wrapf(ErrDirLocked, "dir = %s", dir)
+	}
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "Flock failed. path = %s", path)
+	}
+	return file, nil
+}
+
+// Close releases the directory, nil journal does nothing.
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.lock.Close()
+}
+
+// Open returns log of the file, the log file is created on the first record.
+// It returns nil if journal is disabled.
+func (j *journal) Open(key ObjectKey) *journalLog {
+	if j == nil {
+		return nil
+	}
+	seq := atomic.AddUint64(&j.seq, 1)
+	return &journalLog{
+		journal: j,
+		key:     key,
+		path:    filepath.Join(j.dir, fmt.Sprintf("%s.%016x", filepath.Base(key), seq)),
+	}
+}
+
+// Write appends a write record, nil log does nothing.
+func (l *journalLog) Write(offset int64, data []byte) error {
+	if l == nil {
+		return nil
+	}
+	return l.append(journalRecord{op: journalWrite, offset: offset, data: data})
+}
+
+// Truncate appends a truncate record, nil log does nothing.
+func (l *journalLog) Truncate(size int64) error {
+	if l == nil {
+		return nil
+	}
+	return l.append(journalRecord{op: journalTruncate, offset: size})
+}
+
+// Commit removes the log, after the file is saved.
+func (l *journalLog) Commit() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	l.file.Close()
+	l.file = nil
+	return os.Remove(l.path)
+}
+
+func (l *journalLog) append(record journalRecord) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		l.file = file
+	}
+
+	body := make([]byte, 9, 9+len(record.data))
+	body[0] = record.op
+	binary.BigEndian.PutUint64(body[1:], uint64(record.offset))
+	body = append(body, record.data...)
+	if l.journal.cipher != nil {
+		var err error
+		body, err = l.journal.cipher.Seal(nil, l.key, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(body))
+	_, err := l.file.Write(append(header, body...))
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Replay calls fn with records of each log in order, and removes the log
+// if fn succeeded.
+func (j *journal) Replay(fn func(key ObjectKey, records []journalRecord) error) error {
+	if j == nil {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+
+	// Sort by sequence number
+	sort.Slice(infos, func(a, b int) bool {
+		return filepath.Ext(infos[a].Name()) < filepath.Ext(infos[b].Name())
+	})
+	for _, info := range infos {
+		if info.Name() == dirLockName {
+			continue
+		}
+		key := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		path := filepath.Join(j.dir, info.Name())
+		records, err := j.read(key, path)
+		if err != nil {
+			return errors.Wrapf(err, "journal %s is broken", path)
+		}
+		j.logger.Info("Replay journal", zap.String("key", key), zap.Int("records", len(records)))
+		err = fn(key, records)
+		if err != nil {
+			return errors.Wrapf(err, "failed to replay journal %s", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *journal) read(key ObjectKey, path string) ([]journalRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]journalRecord, 0)
+	r := bytes.NewReader(data)
+	for {
+		header := make([]byte, 8)
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			// EOF, or torn header of the last record
+			return records, nil
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[0:]))
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			// Torn last record was not acknowledged
+			j.logger.Warn("journal has torn record", zap.String("path", path))
+			return records, nil
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+			if r.Len() == 0 {
+				j.logger.Warn("journal has torn record", zap.String("path", path))
+				return records, nil
+			}
+			// Acknowledged records follow, they must not be dropped.
+			return nil, errors.Wrapf(ErrCorruptObject, "crc mismatch at record %d", len(records))
+		}
+
+		if j.cipher != nil {
+			body, err = j.cipher.Open(nil, key, body)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(body) < 9 {
+			return nil, ErrCorruptObject
+		}
+		records = append(records, journalRecord{
+			op:     body[0],
+			offset: int64(binary.BigEndian.Uint64(body[1:])),
+			data:   body[9:],
+		})
+	}
+}
+
+// replayJournal applies writes in the journal, and saves the files.
+func (s *Session) replayJournal() error {
+	return s.journal.Replay(func(key ObjectKey, records []journalRecord) error {
+		exist, err := s.storage.IsExist(key)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			// The file was removed, or it was created but not saved.
+			s.logger.Warn("file in journal is not found", zap.String("key", key))
+			return nil
+		}
+		file, err := s.NewFile(key)
+		if err != nil {
+			return err
+		}
+
+		opened := NewOpenedFile(file)
+		opened.log = nil // don't write journal again
+		for _, r := range records {
+			switch r.op {
+			case journalWrite:
+				_, status := opened.Write(r.data, r.offset)
+				if !status.Ok() {
+					return errors.Errorf("replay write failed: %v", status)
+				}
+			case journalTruncate:
+				err := file.Truncate(r.offset)
+				if err != nil {
+					return err
+				}
+			default:
+				return errors.Errorf("unknown journal record type %d", r.op)
+			}
+		}
+		return file.Save()
+	})
+}
@@ -0,0 +1,134 @@
+package bucketsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/errors"
+)
+
+// writeUnsaved writes to the file, and leaves the journal as if the process
+// died before saving it. It returns the path of the journal. The session
+// can be closed, the file is not saved until it's released.
+func writeUnsaved(t *testing.T, fs *FileSystem, name string) string {
+	file, status := fs.Open(name, uint32(os.O_WRONLY), testContext)
+	if status != fuse.OK {
+		t.Fatal(status)
+	}
+	if _, status := file.Write([]byte("first"), 0); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if status := fs.Truncate(name, 3, testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if _, status := file.Write([]byte("second"), 10); status != fuse.OK {
+		t.Fatal(status)
+	}
+
+	logs, err := filepath.Glob(filepath.Join(fs.Sess.config.JournalDir, "*.*"))
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("journal: %v %v", logs, err)
+	}
+	return logs[0]
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalReplayTornTail(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.JournalDir = filepath.Join(filepath.Dir(config.LocalPath), "journal")
+
+	fs := mountTestFS(t, config)
+	writeTestFile(t, fs, "file", []byte("saved content"))
+	path := writeUnsaved(t, fs, "file")
+	fs.Close()
+	// Torn record, its write was not acknowledged
+	appendFile(t, path, []byte{0, 0, 1, 0, 1, 2, 3, 4, 5, 6})
+
+	fs = mountTestFS(t, config)
+	want := append([]byte("fir"), 0, 0, 0, 0, 0, 0, 0)
+	want = append(want, "second"...)
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("replayed journal is not removed: %v", err)
+	}
+
+	// Replayed once
+	fs.Close()
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, want) {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+}
+
+func TestJournalReplayCorrupt(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.JournalDir = filepath.Join(filepath.Dir(config.LocalPath), "journal")
+
+	fs := mountTestFS(t, config)
+	writeTestFile(t, fs, "file", []byte("saved content"))
+	path := writeUnsaved(t, fs, "file")
+	fs.Close()
+
+	// Broken first record, acknowledged records follow it
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[10] ^= 1
+	err = ioutil.WriteFile(path, raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess, err := NewSession(config); err == nil {
+		sess.Close()
+		t.Fatal("corrupt journal is replayed")
+	}
+}
+
+func TestJournalLocked(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.JournalDir = filepath.Join(filepath.Dir(config.LocalPath), "journal")
+
+	fs := mountTestFS(t, config)
+	writeTestFile(t, fs, "file", []byte("saved content"))
+	path := writeUnsaved(t, fs, "file")
+
+	// Journal of the running mount is not replayed by another session
+	if sess, err := NewSession(config); errors.Cause(err) != ErrDirLocked {
+		if err == nil {
+			sess.Close()
+		}
+		t.Fatalf("second session: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("journal of the running mount: %v", err)
+	}
+
+	fs.Close()
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("journal is not replayed after close: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package bucketsync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestHardLinkNlink(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	fs := mountTestFS(t, config)
+	writeTestFile(t, fs, "file", []byte("content"))
+	if status := fs.Mkdir("dir", 0755, testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	nlink := func(name string) uint32 {
+		attr, status := fs.GetAttr(name, testContext)
+		if status != fuse.OK {
+			t.Fatalf("GetAttr %s: %v", name, status)
+		}
+		return attr.Nlink
+	}
+
+	for _, name := range []string{"dir/link", "link"} {
+		if status := fs.Link("file", name, testContext); status != fuse.OK {
+			t.Fatalf("Link %s: %v", name, status)
+		}
+	}
+	if n := nlink("file"); n != 3 || nlink("dir/link") != 3 {
+		t.Fatalf("nlink = %d after links", n)
+	}
+	if status := fs.Link("dir", "dir2", testContext); status != fuse.EPERM {
+		t.Fatalf("link of directory: %v", status)
+	}
+
+	// Renamed over by another file, the link is dropped
+	writeTestFile(t, fs, "other", []byte("other"))
+	if status := fs.Rename("other", "link", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if n := nlink("file"); n != 2 {
+		t.Fatalf("nlink = %d after rename", n)
+	}
+	// Rename to a link of the same node does nothing
+	if status := fs.Rename("file", "dir/link", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if n := nlink("file"); n != 2 {
+		t.Fatalf("nlink = %d after rename to the same node", n)
+	}
+
+	if status := fs.Unlink("file", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	fs.Close()
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	if n := nlink("dir/link"); n != 1 {
+		t.Fatalf("nlink = %d after unlink", n)
+	}
+	if got := readTestFile(t, fs, "dir/link"); !bytes.Equal(got, []byte("content")) {
+		t.Fatalf("read %q", got)
+	}
+}
@@ -0,0 +1,167 @@
+package bucketsync
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// LocalStore is ObjectStore driver for a local directory,
+// e.g. NAS mount point.
+type LocalStore struct {
+	root   string
+	logger *Logger
+}
+
+func NewLocalStore(config *Config, logger *Logger) (*LocalStore, error) {
+	err := os.MkdirAll(config.LocalPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{
+		root:   config.LocalPath,
+		logger: logger,
+	}, nil
+}
+
+func (s *LocalStore) path(key ObjectKey) string {
+	return filepath.Join(s.root, filepath.Base(key))
+}
+
+func (s *LocalStore) Download(key ObjectKey) ([]byte, error) {
+	s.logger.Debug("Download", zap.String("key", key))
+
+	body, cause := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(cause) {
+		return nil, errors.Wrapf(ErrNotFound, "ReadFile failed. key = %s", key)
+	}
+	if cause != nil {
+		return nil, errors.Wrapf(cause, "ReadFile failed. key = %s", key)
+	}
+
+	s.logger.Debug("Download", zap.Int("size", len(body)))
+	return body, nil
+}
+
+func (s *LocalStore) DownloadRange(key ObjectKey, offset, length int64) ([]byte, error) {
+	s.logger.Debug("DownloadRange", zap.String("key", key), zap.Int64("offset", offset), zap.Int64("length", length))
+
+	body, cause := readFileRange(s.path(key), offset, length)
+	if os.IsNotExist(cause) {
+		return nil, errors.Wrapf(ErrNotFound, "ReadAt failed. key = %s", key)
+	}
+	if cause != nil {
+		return nil, errors.Wrapf(cause, "ReadAt failed. key = %s", key)
+	}
+
+	s.logger.Debug("DownloadRange", zap.Int("size", len(body)))
+	return body, nil
+}
+
+// readFileRange reads length bytes from offset, or until the end of file
+func readFileRange(path string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	body := make([]byte, length)
+	n, err := f.ReadAt(body, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return body[:n], nil
+}
+
+func (s *LocalStore) Upload(key ObjectKey, value io.ReadSeeker) error {
+	s.logger.Debug("Upload", zap.String("key", key))
+
+	// Write to temporary file and rename, readers never see partial object.
+	tmp, cause := ioutil.TempFile(s.root, ".upload-")
+	if cause != nil {
+		return errors.Wrapf(cause, "TempFile failed. key = %s", key)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, cause = io.Copy(tmp, value)
+	if cause == nil {
+		cause = tmp.Sync()
+	}
+	if err := tmp.Close(); cause == nil {
+		cause = err
+	}
+	if cause != nil {
+		return errors.Wrapf(cause, "Write failed. key = %s", key)
+	}
+
+	cause = os.Rename(tmp.Name(), s.path(key))
+	if cause != nil {
+		return errors.Wrapf(cause, "Rename failed. key = %s", key)
+	}
+	return nil
+}
+
+func (s *LocalStore) IsExist(key ObjectKey) (bool, error) {
+	_, cause := os.Stat(s.path(key))
+	if os.IsNotExist(cause) {
+		return false, nil
+	}
+	if cause != nil {
+		return false, errors.Wrapf(cause, "Stat failed. key = %s", key)
+	}
+	return true, nil
+}
+
+func (s *LocalStore) Touch(key ObjectKey) (bool, error) {
+	now := time.Now()
+	cause := os.Chtimes(s.path(key), now, now)
+	if os.IsNotExist(cause) {
+		return false, nil
+	}
+	if cause != nil {
+		return false, errors.Wrapf(cause, "Chtimes failed. key = %s", key)
+	}
+	return true, nil
+}
+
+func (s *LocalStore) Delete(key ObjectKey) error {
+	s.logger.Debug("Delete", zap.String("key", key))
+
+	cause := os.Remove(s.path(key))
+	if os.IsNotExist(cause) {
+		return errors.Wrapf(ErrNotFound, "Remove failed. key = %s", key)
+	}
+	if cause != nil {
+		return errors.Wrapf(cause, "Remove failed. key = %s", key)
+	}
+	return nil
+}
+
+func (s *LocalStore) List(fn func(info ObjectInfo) error) error {
+	files, cause := ioutil.ReadDir(s.root)
+	if cause != nil {
+		return errors.Wrap(cause, "ReadDir failed")
+	}
+	for _, file := range files {
+		// Skip temporary files of Upload
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		err := fn(ObjectInfo{
+			Key:          file.Name(),
+			Size:         file.Size(),
+			LastModified: file.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package bucketsync
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// metaCache keeps results of PathWalk and Meta of nodes for a short time,
+// so that FUSE calls don't download directories from the root every time.
+// Local changes invalidate them, changes by other clients are visible
+// after the timeout. Missing paths are not cached. Metadata objects in the
+// memory and disk caches also expire after metaTimeout.
+type metaCache struct {
+	lock         sync.Mutex
+	entryTimeout time.Duration
+	attrTimeout  time.Duration
+	entries      map[string]cachedEntry
+	attrs        map[ObjectKey]cachedAttr
+}
+
+type cachedEntry struct {
+	key     ObjectKey
+	expires time.Time
+}
+
+type cachedAttr struct {
+	meta    Meta
+	expires time.Time
+}
+
+// maxMetaCacheEntries is the number of entries of each map,
+// expired entries are dropped when it's exceeded.
+const maxMetaCacheEntries = 100000
+
+// newMetaCache returns nil if both timeouts are zero
+func newMetaCache(config *Config) *metaCache {
+	c := &metaCache{
+		entryTimeout: seconds(config.EntryTimeout),
+		attrTimeout:  seconds(config.AttrTimeout),
+		entries:      make(map[string]cachedEntry),
+		attrs:        make(map[ObjectKey]cachedAttr),
+	}
+	if c.entryTimeout <= 0 && c.attrTimeout <= 0 {
+		return nil
+	}
+	return c
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// metaTimeout is the longer timeout, a cached metadata object older than
+// it is downloaded again.
+func metaTimeout(config *Config) time.Duration {
+	timeout := seconds(config.EntryTimeout)
+	if attr := seconds(config.AttrTimeout); attr > timeout {
+		timeout = attr
+	}
+	return timeout
+}
+
+func (c *metaCache) entry(path string) (ObjectKey, bool) {
+	if c == nil || c.entryTimeout <= 0 {
+		return "", false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[path]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.key, true
+}
+
+func (c *metaCache) addEntry(path string, key ObjectKey) {
+	if c == nil || c.entryTimeout <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= maxMetaCacheEntries {
+		now := time.Now()
+		for p, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, p)
+			}
+		}
+		if len(c.entries) >= maxMetaCacheEntries {
+			c.entries = make(map[string]cachedEntry)
+		}
+	}
+	c.entries[path] = cachedEntry{key: key, expires: time.Now().Add(c.entryTimeout)}
+}
+
+// invalidatePath drops the path and paths under it
+func (c *metaCache) invalidatePath(path string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, path)
+	prefix := path + "/"
+	for p := range c.entries {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.entries, p)
+		}
+	}
+}
+
+func (c *metaCache) meta(key ObjectKey) (Meta, bool) {
+	if c == nil || c.attrTimeout <= 0 {
+		return Meta{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	a, ok := c.attrs[key]
+	if !ok || time.Now().After(a.expires) {
+		return Meta{}, false
+	}
+	return a.meta, true
+}
+
+func (c *metaCache) addMeta(key ObjectKey, meta Meta) {
+	if c == nil || c.attrTimeout <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.attrs) >= maxMetaCacheEntries {
+		now := time.Now()
+		for k, a := range c.attrs {
+			if now.After(a.expires) {
+				delete(c.attrs, k)
+			}
+		}
+		if len(c.attrs) >= maxMetaCacheEntries {
+			c.attrs = make(map[ObjectKey]cachedAttr)
+		}
+	}
+	c.attrs[key] = cachedAttr{meta: meta, expires: time.Now().Add(c.attrTimeout)}
+}
+
+func (c *metaCache) invalidateMeta(key ObjectKey) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.attrs, key)
+}
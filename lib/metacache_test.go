@@ -0,0 +1,50 @@
+package bucketsync
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetaCacheOtherClient(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.EntryTimeout = 0.1
+	config.AttrTimeout = 0.2
+	config.DiskCacheDir = filepath.Join(filepath.Dir(config.LocalPath), "cache")
+	config.DiskCacheSize = 16
+
+	fs := mountTestFS(t, config)
+	defer fs.Close()
+	writeTestFile(t, fs, "file", []byte("first"))
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, []byte("first")) {
+		t.Fatalf("read %q", got)
+	}
+
+	// Another client without the disk cache
+	otherConfig := *config
+	otherConfig.DiskCacheDir = ""
+	other := mountTestFS(t, &otherConfig)
+	writeTestFile(t, other, "file", []byte("second version"))
+	other.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, []byte("second version")) {
+		t.Fatalf("read %q after the timeout", got)
+	}
+}
+
+func TestCacheGetFresh(t *testing.T) {
+	c := NewCache(1 << 20)
+	c.Add("key", []byte("value"))
+	if _, err := c.GetFresh("key", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetFresh("key", 0); err == nil {
+		t.Fatal("expired value is returned")
+	}
+	if _, err := c.Get("key"); err == nil || c.Stats().Entries != 0 {
+		t.Fatal("expired value is not removed")
+	}
+}
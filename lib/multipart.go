@@ -0,0 +1,247 @@
+package bucketsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Large objects are uploaded by S3 multipart upload. Parts are uploaded
+// concurrently, and a failed part is retried alone. If the upload fails,
+// it is aborted. Uploads left by a crashed client are aborted by gc.
+
+// Packs and their indexes, other keys of bucketsync are objectKeyPattern.
+var packKeyPattern = regexp.MustCompile(`^(pack|index)-[0-9a-f]{16}-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+const minPartSize = 5 << 20 // minimum part size of S3
+
+type multipartConfig struct {
+	threshold   int64
+	partSize    int64
+	concurrency int
+}
+
+func newMultipartConfig(config *Config) multipartConfig {
+	c := multipartConfig{
+		threshold:   int64(config.MultipartThreshold) << 20,
+		partSize:    int64(config.MultipartPartSize) << 20,
+		concurrency: config.MultipartConcurrency,
+	}
+	if c.threshold <= 0 {
+		c.threshold = 16 << 20
+	}
+	if c.partSize < minPartSize {
+		c.partSize = minPartSize
+	}
+	if c.concurrency <= 0 {
+		c.concurrency = 4
+	}
+	return c
+}
+
+func (s *S3Session) uploadMultipart(key ObjectKey, value io.ReadSeeker) error {
+	data, cause := ioutil.ReadAll(value)
+	if cause != nil {
+		return errors.Wrapf(cause, "Read failed. key = %s", key)
+	}
+
+	var uploadID *string
+	err := s.do("CreateMultipartUpload", key, func(ctx aws.Context) error {
+		created, cause := s.svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if cause != nil {
+			return cause
+		}
+		uploadID = created.UploadId
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.Debug("Multipart upload started", zap.String("key", key),
+		zap.String("uploadID", *uploadID), zap.Int("size", len(data)))
+
+	parts, err := s.uploadParts(key, uploadID, data)
+	if err != nil {
+		cause := s.abortUpload(key, uploadID)
+		if cause != nil {
+			s.logger.Error("AbortMultipartUpload failed", zap.String("key", key), zap.Error(cause))
+		}
+		return err
+	}
+
+	err = s.do("CompleteMultipartUpload", key, func(ctx aws.Context) error {
+		_, cause := s.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+		return cause
+	})
+	if errors.Cause(err) == ErrNotFound {
+		// NoSuchUpload, a retried request after the upload is completed
+		// but its response is lost.
+		size, cause := s.objectSize(key)
+		if cause == nil && size == int64(len(data)) {
+			s.logger.Debug("Multipart upload is already completed", zap.String("key", key))
+			return nil
+		}
+	}
+	return err
+}
+
+// objectSize returns the size of the stored object
+func (s *S3Session) objectSize(key ObjectKey) (int64, error) {
+	var size int64
+	err := s.do("HeadObject", key, func(ctx aws.Context) error {
+		head, cause := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if cause != nil {
+			return cause
+		}
+		size = aws.Int64Value(head.ContentLength)
+		return nil
+	})
+	return size, err
+}
+
+func (s *S3Session) abortUpload(key ObjectKey, uploadID *string) error {
+	return s.do("AbortMultipartUpload", key, func(ctx aws.Context) error {
+		_, cause := s.svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+		})
+		return cause
+	})
+}
+
+// uploadParts uploads data in parts concurrently, and returns completed
+// parts ordered by part number.
+func (s *S3Session) uploadParts(key ObjectKey, uploadID *string, data []byte) ([]*s3.CompletedPart, error) {
+	count := (int64(len(data)) + s.multipart.partSize - 1) / s.multipart.partSize
+	numbers := make(chan int64)
+	go func() {
+		for i := int64(0); i < count; i++ {
+			numbers <- i + 1
+		}
+		close(numbers)
+	}()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	parts := make([]*s3.CompletedPart, 0, count)
+	for w := 0; w < s.multipart.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range numbers {
+				lock.Lock()
+				failed := firstErr != nil
+				lock.Unlock()
+				if failed {
+					continue
+				}
+
+				start := (number - 1) * s.multipart.partSize
+				end := start + s.multipart.partSize
+				if end > int64(len(data)) {
+					end = int64(len(data))
+				}
+				part, err := s.uploadPart(key, uploadID, number, data[start:end])
+
+				lock.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if err == nil {
+					parts = append(parts, part)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return *parts[i].PartNumber < *parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+// uploadPart uploads a part, a failed part is retried alone
+func (s *S3Session) uploadPart(key ObjectKey, uploadID *string, number int64, body []byte) (*s3.CompletedPart, error) {
+	var part *s3.CompletedPart
+	err := s.do("UploadPart", key, func(ctx aws.Context) error {
+		uploaded, cause := s.svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int64(number),
+			Body:       bytes.NewReader(body),
+		})
+		if cause != nil {
+			return cause
+		}
+		part = &s3.CompletedPart{ETag: uploaded.ETag, PartNumber: aws.Int64(number)}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "part = %d", number)
+	}
+	return part, nil
+}
+
+// AbortStaleUploads aborts multipart uploads of bucketsync initiated before
+// threshold, they are left by crashed clients. It returns the number of
+// aborted uploads.
+func (s *S3Session) AbortStaleUploads(threshold time.Time) (int, error) {
+	stale := make([]*s3.MultipartUpload, 0)
+	err := s.do("ListMultipartUploads", "", func(ctx aws.Context) error {
+		stale = stale[:0]
+		return s.svc.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+			Bucket: aws.String(s.bucket),
+		}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+			for _, upload := range page.Uploads {
+				key := aws.StringValue(upload.Key)
+				if !objectKeyPattern.MatchString(key) && !packKeyPattern.MatchString(key) {
+					continue
+				}
+				if upload.Initiated != nil && upload.Initiated.Before(threshold) {
+					stale = append(stale, upload)
+				}
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, upload := range stale {
+		err := s.abortUpload(aws.StringValue(upload.Key), upload.UploadId)
+		if err != nil {
+			return i, err
+		}
+		s.logger.Debug("Aborted stale upload", zap.String("key", *upload.Key))
+	}
+	return len(stale), nil
+}
@@ -0,0 +1,189 @@
+package bucketsync
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 serves multipart uploads of S3, with injected failures
+type fakeS3 struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int64][]byte
+	requests map[int64]int // UploadPart requests by part number
+
+	failPart     map[int64]int // part fails with 500 this many times
+	denyPart     int64         // part is rejected with 403
+	loseComplete bool          // response of CompleteMultipartUpload is lost once
+	aborted      int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  make(map[string][]byte),
+		uploads:  make(map[string]map[int64][]byte),
+		requests: make(map[int64]int),
+		failPart: make(map[int64]int),
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "POST" && query["uploads"] != nil:
+		uploadID = strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = make(map[int64][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, uploadID)
+
+	case r.Method == "PUT" && uploadID != "":
+		number, _ := strconv.ParseInt(query.Get("partNumber"), 10, 64)
+		f.requests[number]++
+		if number == f.denyPart {
+			s3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		if f.failPart[number] > 0 {
+			f.failPart[number]--
+			s3Error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			s3Error(w, http.StatusNotFound, s3.ErrCodeNoSuchUpload)
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, number))
+
+	case r.Method == "POST" && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			s3Error(w, http.StatusNotFound, s3.ErrCodeNoSuchUpload)
+			return
+		}
+		completed := struct {
+			Parts []struct{ PartNumber int64 } `xml:"Part"`
+		}{}
+		xml.Unmarshal(body, &completed)
+		object := []byte{}
+		for i, part := range completed.Parts {
+			if part.PartNumber != int64(i+1) {
+				s3Error(w, http.StatusBadRequest, "InvalidPartOrder")
+				return
+			}
+			object = append(object, parts[part.PartNumber]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, uploadID)
+		if f.loseComplete {
+			f.loseComplete = false
+			s3Error(w, http.StatusServiceUnavailable, "ServiceUnavailable")
+			return
+		}
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`, key)
+
+	case r.Method == "DELETE" && uploadID != "":
+		delete(f.uploads, uploadID)
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "HEAD":
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func newTestS3Session(t *testing.T, config *Config, url string) *S3Session {
+	logger, err := NewLogger(config.LogOutputPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := s3.New(session.Must(session.NewSession()), &aws.Config{
+		Endpoint:         aws.String(url),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	return &S3Session{
+		svc:    svc,
+		logger: logger,
+		bucket: "bucket",
+		multipart: multipartConfig{
+			threshold:   1 << 20,
+			partSize:    minPartSize,
+			concurrency: 2,
+		},
+		retries: 2,
+		timeout: 10 * time.Second,
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestS3Session(t, config, server.URL)
+
+	data := make([]byte, 2*minPartSize+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	// Failed part is retried alone, and the retried completion succeeds
+	fake.failPart[2] = 1
+	fake.loseComplete = true
+	if err := s.Upload("object", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects["object"], data) {
+		t.Fatalf("uploaded %d bytes", len(fake.objects["object"]))
+	}
+	if fake.requests[1] != 1 || fake.requests[2] != 2 || fake.requests[3] != 1 {
+		t.Fatalf("part requests: %v", fake.requests)
+	}
+
+	// Rejected part aborts the upload
+	fake.denyPart = 3
+	if err := s.Upload("rejected", bytes.NewReader(data)); err == nil {
+		t.Fatal("rejected upload succeeded")
+	}
+	if fake.aborted != 1 || len(fake.uploads) != 0 {
+		t.Fatalf("aborted = %d, %d uploads are left", fake.aborted, len(fake.uploads))
+	}
+	if _, ok := fake.objects["rejected"]; ok {
+		t.Fatal("rejected object is completed")
+	}
+}
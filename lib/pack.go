@@ -0,0 +1,382 @@
+package bucketsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// In packing mode, staged objects are uploaded together as a pack object.
+// Each pack has an index object, which maps object keys to the location
+// in the pack. Indexes are loaded on startup, the newest location of a key
+// is used.
+//
+// A pack is uploaded before its index, so an index always refers to
+// a complete pack. Packs are named by upload time, and sorted by name.
+// Packs without live objects are deleted by gc, and packs with few live
+// extents are rewritten. Packs with live metadata are not rewritten, gc
+// may not know a newer version, and the rewritten pack is newer than it.
+// If a pack is deleted by gc, indexes are loaded again.
+const (
+	packPrefix      = "pack-"
+	packIndexPrefix = "index-"
+)
+
+// packEntry is an object to be packed, data is encoded by Storage
+type packEntry struct {
+	key  ObjectKey
+	kind objectKind
+	data []byte
+}
+
+// packLocation is where an object is stored in a pack
+type packLocation struct {
+	Key    ObjectKey `json:"key"`
+	Pack   string    `json:"-"`
+	Offset int64     `json:"offset"`
+	Length int64     `json:"length"`
+	Extent bool      `json:"extent,omitempty"` // false in older indexes
+}
+
+// packIndex is stored in the index object
+type packIndex struct {
+	Pack    string          `json:"pack"`
+	Entries []*packLocation `json:"entries"`
+}
+
+// packUploader is implemented by ObjectStore which can store a pack
+type packUploader interface {
+	UploadPack(entries []packEntry) error
+}
+
+// packStore is ObjectStore wrapper, which reads packed objects from packs.
+// Objects which are not packed are read from the backend as they are.
+type packStore struct {
+	ObjectStore
+	logger    *Logger
+	lock      sync.RWMutex
+	locations map[ObjectKey]*packLocation
+	indexes   map[string]*packIndex // by pack name
+}
+
+func newPackStore(backend ObjectStore, logger *Logger) (*packStore, error) {
+	p := &packStore{
+		ObjectStore: backend,
+		logger:      logger,
+		locations:   make(map[ObjectKey]*packLocation),
+		indexes:     make(map[string]*packIndex),
+	}
+
+	names, err := p.listIndexes()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		index, err := p.loadIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		p.add(index)
+	}
+	logger.Debug("Pack indexes loaded", zap.Int("packs", len(p.indexes)),
+		zap.Int("objects", len(p.locations)))
+	return p, nil
+}
+
+func (p *packStore) listIndexes() ([]string, error) {
+	names := make([]string, 0)
+	err := p.ObjectStore.List(func(info ObjectInfo) error {
+		if strings.HasPrefix(info.Key, packIndexPrefix) {
+			names = append(names, info.Key)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (p *packStore) loadIndex(name string) (*packIndex, error) {
+	data, err := p.ObjectStore.Download(name)
+	if err != nil {
+		return nil, err
+	}
+	index := &packIndex{}
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		return nil, errors.Wrapf(ErrCorruptObject, "key = %s, %s", name, err)
+	}
+	return index, nil
+}
+
+// add must be called with lock, or before packStore is shared.
+// Location in the newer pack is used.
+func (p *packStore) add(index *packIndex) {
+	for _, location := range index.Entries {
+		location.Pack = index.Pack
+		if current, ok := p.locations[location.Key]; ok && current.Pack > location.Pack {
+			continue
+		}
+		p.locations[location.Key] = location
+	}
+	p.indexes[index.Pack] = index
+}
+
+// reload loads indexes uploaded by other clients, and forgets the pack
+// which is deleted by gc.
+func (p *packStore) reload(deleted string) error {
+	names, err := p.listIndexes()
+	if err != nil {
+		return err
+	}
+	loaded := make([]*packIndex, 0)
+	for _, name := range names {
+		p.lock.RLock()
+		_, ok := p.indexes[packPrefix+strings.TrimPrefix(name, packIndexPrefix)]
+		p.lock.RUnlock()
+		if ok {
+			continue
+		}
+		index, err := p.loadIndex(name)
+		if errors.Cause(err) == ErrNotFound {
+			continue // deleted after List
+		}
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, index)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.indexes, deleted)
+	for _, index := range loaded {
+		p.indexes[index.Pack] = index
+	}
+	p.locations = make(map[ObjectKey]*packLocation)
+	for _, index := range p.indexes {
+		p.add(index)
+	}
+	p.logger.Debug("Pack indexes reloaded", zap.String("deleted", deleted),
+		zap.Int("packs", len(p.indexes)), zap.Int("objects", len(p.locations)))
+	return nil
+}
+
+func (p *packStore) locate(key ObjectKey) (*packLocation, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	location, ok := p.locations[key]
+	return location, ok
+}
+
+// readPacked reads the packed object by read, it returns false if the key
+// is not packed. If the pack is deleted by gc, it's read again after the
+// indexes are reloaded.
+func (p *packStore) readPacked(key ObjectKey, read func(location *packLocation) ([]byte, error)) ([]byte, bool, error) {
+	for retry := false; ; retry = true {
+		location, ok := p.locate(key)
+		if !ok {
+			return nil, false, nil
+		}
+		data, err := read(location)
+		if errors.Cause(err) != ErrNotFound || retry {
+			return data, true, err
+		}
+		err = p.reload(location.Pack)
+		if err != nil {
+			return nil, true, err
+		}
+	}
+}
+
+func (p *packStore) Download(key ObjectKey) ([]byte, error) {
+	data, ok, err := p.readPacked(key, func(location *packLocation) ([]byte, error) {
+		data, err := p.ObjectStore.DownloadRange(location.Pack, location.Offset, location.Length)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) != location.Length {
+			return nil, errors.Wrapf(ErrCorruptObject, "pack is truncated. key = %s, pack = %s", key, location.Pack)
+		}
+		return data, nil
+	})
+	if !ok {
+		return p.ObjectStore.Download(key)
+	}
+	return data, err
+}
+
+func (p *packStore) DownloadRange(key ObjectKey, offset, length int64) ([]byte, error) {
+	data, ok, err := p.readPacked(key, func(location *packLocation) ([]byte, error) {
+		if offset >= location.Length {
+			return []byte{}, nil
+		}
+		length := length
+		if offset+length > location.Length {
+			length = location.Length - offset
+		}
+		return p.ObjectStore.DownloadRange(location.Pack, location.Offset+offset, length)
+	})
+	if !ok {
+		return p.ObjectStore.DownloadRange(key, offset, length)
+	}
+	return data, err
+}
+
+func (p *packStore) IsExist(key ObjectKey) (bool, error) {
+	if _, ok := p.locate(key); ok {
+		return true, nil
+	}
+	return p.ObjectStore.IsExist(key)
+}
+
+// Touch returns false for packed object, it's packed again so that gc
+// keeps it.
+func (p *packStore) Touch(key ObjectKey) (bool, error) {
+	if _, ok := p.locate(key); ok {
+		return false, nil
+	}
+	t, ok := p.ObjectStore.(toucher)
+	if !ok {
+		return false, nil
+	}
+	return t.Touch(key)
+}
+
+// Delete forgets packed object, the pack is deleted by gc
+func (p *packStore) Delete(key ObjectKey) error {
+	p.lock.Lock()
+	_, ok := p.locations[key]
+	delete(p.locations, key)
+	p.lock.Unlock()
+	if ok {
+		return nil
+	}
+	return p.ObjectStore.Delete(key)
+}
+
+// UploadPack uploads entries as a pack, and its index.
+// If a key appears twice, the latter is used.
+func (p *packStore) UploadPack(entries []packEntry) error {
+	name := fmt.Sprintf("%016x-%s", time.Now().UnixNano(), NewObjectKey())
+	index := &packIndex{
+		Pack:    packPrefix + name,
+		Entries: make([]*packLocation, 0, len(entries)),
+	}
+	pack := &bytes.Buffer{}
+	for _, entry := range entries {
+		index.Entries = append(index.Entries, &packLocation{
+			Key:    entry.key,
+			Offset: int64(pack.Len()),
+			Length: int64(len(entry.data)),
+			Extent: entry.kind == kindExtent,
+		})
+		pack.Write(entry.data)
+	}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	err = p.ObjectStore.Upload(index.Pack, bytes.NewReader(pack.Bytes()))
+	if err != nil {
+		return err
+	}
+	err = p.ObjectStore.Upload(packIndexPrefix+name, bytes.NewReader(indexJSON))
+	if err != nil {
+		return err
+	}
+	p.logger.Debug("Pack uploaded", zap.String("pack", index.Pack),
+		zap.Int("objects", len(entries)), zap.Int("size", pack.Len()))
+
+	p.lock.Lock()
+	p.add(index)
+	p.lock.Unlock()
+	return nil
+}
+
+// deletePack deletes the pack and its index, objects in the pack
+// are forgotten if they are not packed again.
+func (p *packStore) deletePack(pack string) error {
+	err := p.ObjectStore.Delete(packIndexPrefix + strings.TrimPrefix(pack, packPrefix))
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	if index, ok := p.indexes[pack]; ok {
+		for _, location := range index.Entries {
+			if p.locations[location.Key] == location {
+				delete(p.locations, location.Key)
+			}
+		}
+		delete(p.indexes, pack)
+	}
+	p.lock.Unlock()
+	return p.ObjectStore.Delete(pack)
+}
+
+// packUsage is size of live objects in a pack
+type packUsage struct {
+	pack  string
+	live  []*packLocation
+	meta  int   // live objects which are not known as extents
+	bytes int64 // size of live objects
+	total int64
+}
+
+// usage returns packUsage of all packs. An object is live if it's in
+// reachable, and it's the newest location of the key.
+func (p *packStore) usage(reachable map[ObjectKey]struct{}) []*packUsage {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	usages := make([]*packUsage, 0, len(p.indexes))
+	for pack, index := range p.indexes {
+		u := &packUsage{pack: pack}
+		for _, location := range index.Entries {
+			u.total += location.Length
+			if _, ok := reachable[location.Key]; !ok || p.locations[location.Key] != location {
+				continue
+			}
+			u.live = append(u.live, location)
+			u.bytes += location.Length
+			if !location.Extent {
+				u.meta++
+			}
+		}
+		usages = append(usages, u)
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].pack < usages[j].pack })
+	return usages
+}
+
+// repack uploads live extents of the pack as a new pack, and deletes it.
+// Packs with live metadata are refused.
+func (p *packStore) repack(u *packUsage) error {
+	if u.meta > 0 {
+		return errors.Errorf("pack has live metadata. pack = %s", u.pack)
+	}
+	entries := make([]packEntry, 0, len(u.live))
+	for _, location := range u.live {
+		if current, ok := p.locate(location.Key); !ok || current != location {
+			continue
+		}
+		data, err := p.ObjectStore.DownloadRange(u.pack, location.Offset, location.Length)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, packEntry{key: location.Key, kind: kindExtent, data: data})
+	}
+	if len(entries) > 0 {
+		err := p.UploadPack(entries)
+		if err != nil {
+			return err
+		}
+	}
+	return p.deletePack(u.pack)
+}
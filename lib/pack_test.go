@@ -0,0 +1,120 @@
+package bucketsync
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestPackStore(t *testing.T) (*packStore, ObjectStore, func()) {
+	config, cleanup := newTestConfig(t)
+	logger, err := NewLogger(config.LogOutputPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := NewLocalStore(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPackStore(local, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, local, cleanup
+}
+
+func TestPackIndex(t *testing.T) {
+	p, local, cleanup := newTestPackStore(t)
+	defer cleanup()
+
+	err := p.UploadPack([]packEntry{
+		{key: "meta", kind: kindMeta, data: []byte("old")},
+		{key: "extent", kind: kindExtent, data: []byte("extent data")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.UploadPack([]packEntry{{key: "meta", kind: kindMeta, data: []byte("new")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Loaded by another client, the newest location is used
+	loaded, err := newPackStore(local, p.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*packStore{p, loaded} {
+		if data, err := s.Download("meta"); err != nil || string(data) != "new" {
+			t.Fatalf("meta = %q, %v", data, err)
+		}
+		if data, err := s.DownloadRange("extent", 7, 10); err != nil || string(data) != "data" {
+			t.Fatalf("extent range = %q, %v", data, err)
+		}
+		location, _ := s.locate("extent")
+		if !location.Extent {
+			t.Fatal("kind is not stored in the index")
+		}
+	}
+
+	// Older index added later doesn't win
+	old := loaded.indexes[loaded.locations["extent"].Pack]
+	loaded.add(old)
+	if data, _ := loaded.Download("meta"); string(data) != "new" {
+		t.Fatalf("meta = %q after older index", data)
+	}
+}
+
+func TestPackRepack(t *testing.T) {
+	p, local, cleanup := newTestPackStore(t)
+	defer cleanup()
+
+	live := bytes.Repeat([]byte("l"), 10)
+	dead := bytes.Repeat([]byte("d"), 100)
+	err := p.UploadPack([]packEntry{
+		{key: "live", kind: kindExtent, data: live},
+		{key: "dead", kind: kindExtent, data: dead},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.UploadPack([]packEntry{
+		{key: "meta", kind: kindMeta, data: []byte("meta")},
+		{key: "dead2", kind: kindExtent, data: dead},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mounted before gc
+	mounted, err := newPackStore(local, p.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reachable := map[ObjectKey]struct{}{"live": {}, "meta": {}}
+	usages := p.usage(reachable)
+	if len(usages) != 2 || usages[0].meta != 0 || usages[1].meta != 1 {
+		t.Fatalf("usage: %+v %+v", usages[0], usages[1])
+	}
+	if err := p.repack(usages[1]); err == nil {
+		t.Fatal("pack with live metadata is repacked")
+	}
+	if err := p.repack(usages[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.indexes[usages[0].pack]; ok {
+		t.Fatal("repacked pack is not deleted")
+	}
+
+	// Stale index of the mount is reloaded
+	for _, s := range []*packStore{p, mounted} {
+		if data, err := s.Download("live"); err != nil || !bytes.Equal(data, live) {
+			t.Fatalf("live = %q, %v", data, err)
+		}
+		if data, err := s.Download("meta"); err != nil || string(data) != "meta" {
+			t.Fatalf("meta = %q, %v", data, err)
+		}
+	}
+	if _, ok := mounted.indexes[usages[0].pack]; ok {
+		t.Fatal("deleted pack is not forgotten")
+	}
+}
@@ -0,0 +1,205 @@
+package bucketsync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Permissions are checked by the filesystem like the kernel does, the
+// mount doesn't use default_permissions because of ACLs. root can do
+// anything, except executing a file without execute bits.
+
+// Permission bits of access(2)
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+// caller is the process of a FUSE request
+type caller struct {
+	uid    uint32
+	gid    uint32
+	pid    uint32
+	groups map[uint32]bool // supplementary groups, loaded on demand
+}
+
+func newCaller(context *fuse.Context) *caller {
+	return &caller{uid: context.Uid, gid: context.Gid, pid: context.Pid}
+}
+
+func (c *caller) inGroup(gid uint32) bool {
+	if gid == c.gid {
+		return true
+	}
+	if c.groups == nil {
+		c.groups = procGroups(c.pid)
+	}
+	return c.groups[gid]
+}
+
+// procGroups reads supplementary groups of the process. FUSE doesn't tell
+// them, the process may have exited.
+func procGroups(pid uint32) map[uint32]bool {
+	groups := make(map[uint32]bool)
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return groups
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err == nil {
+				groups[uint32(gid)] = true
+			}
+		}
+		break
+	}
+	return groups
+}
+
+// permits returns true if the caller has all of perm on the node, by the
+// access check algorithm of POSIX ACL. Without ACL, it's the same as
+// mode bits.
+func (c *caller) permits(meta Meta, perm uint32) bool {
+	if c.uid == 0 {
+		// root can't execute a file without execute bits
+		if perm&permExec != 0 && meta.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return meta.Mode&0111 != 0
+		}
+		return true
+	}
+	if c.uid == meta.UID {
+		return (meta.Mode>>6)&perm == perm
+	}
+
+	a := meta.acl(aclAccessName)
+	if a == nil {
+		if c.inGroup(meta.GID) {
+			return (meta.Mode>>3)&perm == perm
+		}
+		return meta.Mode&perm == perm
+	}
+
+	mask := uint32(7)
+	if e := a.find(aclMask); e != nil {
+		mask = uint32(e.perm)
+	}
+	for _, e := range a {
+		if e.tag == aclUser && e.id == c.uid {
+			return uint32(e.perm)&mask&perm == perm
+		}
+	}
+	matched := false
+	for _, e := range a {
+		if e.tag == aclGroupObj && c.inGroup(meta.GID) || e.tag == aclGroup && c.inGroup(e.id) {
+			if uint32(e.perm)&mask&perm == perm {
+				return true
+			}
+			matched = true
+		}
+	}
+	if matched {
+		return false
+	}
+	return meta.Mode&perm == perm
+}
+
+// owns returns true if the caller can change attributes of the node
+func (c *caller) owns(meta Meta) bool {
+	return c.uid == 0 || c.uid == meta.UID
+}
+
+// chmod returns mode set by chmod(2). setgid is dropped if the caller
+// is not in the group of the file.
+func (c *caller) chmod(meta Meta, mode uint32) (uint32, fuse.Status) {
+	if !c.owns(meta) {
+		return 0, fuse.EPERM
+	}
+	if c.uid != 0 && meta.Mode&syscall.S_IFMT != syscall.S_IFDIR && !c.inGroup(meta.GID) {
+		mode &^= syscall.S_ISGID
+	}
+	return (meta.Mode & syscall.S_IFMT) | mode, fuse.OK
+}
+
+// chown applies chown(2) to meta, -1 keeps the current id. Only root can
+// change the owner, and the owner can change the group to its group.
+func (c *caller) chown(meta *Meta, uid uint32, gid uint32) fuse.Status {
+	if uid == ^uint32(0) {
+		uid = meta.UID
+	}
+	if gid == ^uint32(0) {
+		gid = meta.GID
+	}
+	if c.uid != 0 {
+		if uid != meta.UID || c.uid != meta.UID {
+			return fuse.EPERM
+		}
+		if gid != meta.GID && !c.inGroup(gid) {
+			return fuse.EPERM
+		}
+	}
+
+	meta.UID = uid
+	meta.GID = gid
+	// Same as Linux, setuid and setgid of executable are dropped
+	if meta.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		meta.Mode &^= syscall.S_ISUID
+		if meta.Mode&syscall.S_IXGRP != 0 {
+			meta.Mode &^= syscall.S_ISGID
+		}
+	}
+	return fuse.OK
+}
+
+// utimens applies utimens(2) to meta, nil keeps the current time.
+// FUSE doesn't tell UTIME_NOW, so users with write permission can also set
+// any time.
+func (c *caller) utimens(meta *Meta, atime *time.Time, mtime *time.Time) fuse.Status {
+	if !c.owns(*meta) && !c.permits(*meta, permWrite) {
+		return fuse.EACCES
+	}
+	if atime != nil {
+		meta.Atime = *atime
+	}
+	if mtime != nil {
+		meta.Mtime = *mtime
+	}
+	meta.Ctime = time.Now()
+	return fuse.OK
+}
+
+// xattrPermits checks permission of xattr name, write is set for setxattr
+// and removexattr. user.* follows mode bits, other namespaces are changed
+// only by root. ACLs are checked by setACL.
+func (c *caller) xattrPermits(meta Meta, name string, write bool) fuse.Status {
+	switch {
+	case name == aclAccessName || name == aclDefaultName:
+		return fuse.OK
+	case strings.HasPrefix(name, "user."):
+		perm := uint32(permRead)
+		if write {
+			perm = permWrite
+		}
+		if !c.permits(meta, perm) {
+			return fuse.EACCES
+		}
+	case write && c.uid != 0:
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
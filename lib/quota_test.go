@@ -0,0 +1,113 @@
+package bucketsync
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+func createTestFile(t *testing.T, fs *FileSystem, name string) nodefs.File {
+	file, status := fs.Create(name, uint32(os.O_WRONLY), 0644, testContext)
+	if status != fuse.OK {
+		t.Fatalf("Create %s: %v", name, status)
+	}
+	return file
+}
+
+func TestQuotaReserve(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.QuotaSize = 1
+
+	fs := mountTestFS(t, config)
+	defer fs.Close()
+	usage := fs.Sess.usage
+	data := make([]byte, 600<<10)
+
+	a := createTestFile(t, fs, "a")
+	if _, status := a.Write(data, 0); status != fuse.OK {
+		t.Fatal(status)
+	}
+	// Unsaved growth of the other file is reserved
+	b := createTestFile(t, fs, "b")
+	if _, status := b.Write(data, 0); status != fuse.Status(syscall.ENOSPC) {
+		t.Fatalf("write beyond quota: %v", status)
+	}
+	if status := a.Flush(); status != fuse.OK {
+		t.Fatal(status)
+	}
+	a.Release()
+	if bytes, _ := usage.usage(); bytes != int64(len(data)) || usage.reserved != 0 {
+		t.Fatalf("bytes = %d, reserved = %d after save", bytes, usage.reserved)
+	}
+
+	if _, status := b.Write(data[:300<<10], 0); status != fuse.OK {
+		t.Fatal(status)
+	}
+	b.Release()
+	if status := fs.Truncate("a", 1<<20, testContext); status != fuse.Status(syscall.ENOSPC) {
+		t.Fatalf("truncate beyond quota: %v", status)
+	}
+	if status := fs.Truncate("a", 100, testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if bytes, _ := usage.usage(); bytes != 100+300<<10 || usage.reserved != 0 {
+		t.Fatalf("bytes = %d, reserved = %d after release", bytes, usage.reserved)
+	}
+}
+
+func TestQuotaInodes(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.QuotaInodes = 2 // root and a file
+
+	fs := mountTestFS(t, config)
+	defer fs.Close()
+	writeTestFile(t, fs, "file", []byte("content"))
+	if _, status := fs.Create("other", uint32(os.O_WRONLY), 0644, testContext); status != fuse.Status(syscall.ENOSPC) {
+		t.Fatalf("create beyond quota: %v", status)
+	}
+	if status := fs.Mkdir("dir", 0755, testContext); status != fuse.Status(syscall.ENOSPC) {
+		t.Fatalf("mkdir beyond quota: %v", status)
+	}
+	if status := fs.Unlink("file", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if status := fs.Mkdir("dir", 0755, testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+}
+
+func TestQuotaUnlinkOpened(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	fs := mountTestFS(t, config)
+	defer fs.Close()
+	file := createTestFile(t, fs, "file")
+	if _, status := file.Write([]byte("content"), 0); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if status := file.Flush(); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if status := fs.Unlink("file", testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+
+	// Written after unlink, the garbage is not counted
+	if _, status := file.Write([]byte("more content"), 7); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if status := file.Flush(); status != fuse.OK {
+		t.Fatal(status)
+	}
+	file.Release()
+	bytes, inodes := fs.Sess.usage.usage()
+	if bytes != 0 || inodes != 1 || fs.Sess.usage.reserved != 0 {
+		t.Fatalf("bytes = %d, inodes = %d, reserved = %d", bytes, inodes, fs.Sess.usage.reserved)
+	}
+}
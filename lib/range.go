@@ -0,0 +1,175 @@
+package bucketsync
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Small part of an extent is read by range request, instead of downloading
+// the whole object. Body of an object is seekable if it is not compressed,
+// and not encrypted or encrypted by cipherAESGCMSegmented.
+// Layout of an object is read by the first range request, and kept since
+// extents are never rewritten.
+
+// maxLayouts is the number of object layouts kept in memory
+const maxLayouts = 64 * 1024
+
+// objectLayout is where the body of a stored object starts
+type objectLayout struct {
+	header []byte // nil if the object has no header
+	cipher byte
+	codec  byte
+	body   int64  // offset of the body
+	nonce  []byte // cipherAESGCMSegmented only
+}
+
+// seekable returns true if a range of the body can be read
+func (l *objectLayout) seekable(s *Storage) bool {
+	if l.codec != codecNone {
+		return false
+	}
+	switch l.cipher {
+	case cipherNone:
+		return s.cipher == nil
+	case cipherAESGCMSegmented:
+		return s.cipher != nil
+	}
+	return false
+}
+
+func (s *Storage) layout(key ObjectKey) (*objectLayout, error) {
+	s.layoutLock.Lock()
+	layout, ok := s.layouts[key]
+	s.layoutLock.Unlock()
+	if ok {
+		return layout, nil
+	}
+
+	nonceSize := 0
+	if s.cipher != nil {
+		nonceSize = s.cipher.aead.NonceSize()
+	}
+	data, err := s.downloadRange(key, 0, int64(objectHeaderLen+nonceSize))
+	if err != nil {
+		return nil, err
+	}
+
+	layout = &objectLayout{cipher: cipherNone, codec: codecNone}
+	if bytes.HasPrefix(data, []byte(objectMagic)) {
+		header, err := parseObjectHeader(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key = %s", key)
+		}
+		layout.header = append([]byte{}, data[:header.len]...)
+		layout.cipher = header.cipher
+		layout.codec = header.codec
+		layout.body = int64(header.len)
+		if header.cipher == cipherAESGCMSegmented && s.cipher != nil {
+			if len(data) < header.len+nonceSize {
+				return nil, errors.Wrapf(ErrCorruptObject, "key = %s", key)
+			}
+			layout.nonce = append([]byte{}, data[header.len:header.len+nonceSize]...)
+			layout.body += int64(nonceSize)
+		}
+	}
+
+	s.layoutLock.Lock()
+	if len(s.layouts) >= maxLayouts {
+		s.layouts = make(map[ObjectKey]*objectLayout)
+	}
+	s.layouts[key] = layout
+	s.layoutLock.Unlock()
+	return layout, nil
+}
+
+// downloadRange reads the stored extent from disk cache or the backend
+func (s *Storage) downloadRange(key ObjectKey, offset, length int64) ([]byte, error) {
+	if s.diskCache != nil {
+		if data, ok := s.diskCache.getRange(key, kindExtent, offset, length); ok {
+			return data, nil
+		}
+	}
+	return s.backend.DownloadRange(key, offset, length)
+}
+
+// forgetLayout is called when the object is rewritten
+func (s *Storage) forgetLayout(key ObjectKey) {
+	s.layoutLock.Lock()
+	delete(s.layouts, key)
+	s.layoutLock.Unlock()
+}
+
+// DownloadRange returns length bytes from offset of the decoded extent.
+// It falls back to DownloadWithCache if the object is not seekable.
+func (s *Storage) DownloadRange(key ObjectKey, offset, length int64) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("Key shouldn't be empty")
+	}
+	if length <= 0 {
+		return []byte{}, nil
+	}
+
+	if cached, err := s.cache.Get(key); err == nil {
+		return sliceRange(cached, offset, length), nil
+	}
+	if s.writeBack != nil {
+		if _, ok := s.writeBack.Get(key); ok {
+			data, err := s.Download(key, kindExtent)
+			if err != nil {
+				return nil, err
+			}
+			return sliceRange(data, offset, length), nil
+		}
+	}
+
+	layout, err := s.layout(key)
+	if err != nil {
+		return nil, err
+	}
+	if !layout.seekable(s) {
+		data, err := s.DownloadWithCache(key, kindExtent)
+		if err != nil {
+			return nil, err
+		}
+		return sliceRange(data, offset, length), nil
+	}
+	s.logger.Debug("DownloadRange", zap.String("key", key), zap.Int64("offset", offset), zap.Int64("length", length))
+
+	if layout.cipher == cipherNone {
+		return s.downloadRange(key, layout.body+offset, length)
+	}
+
+	// Read segments which contain the range
+	sealedSize := int64(segmentSize + s.cipher.aead.Overhead())
+	first := offset / segmentSize
+	last := (offset + length - 1) / segmentSize
+	sealed, err := s.downloadRange(key, layout.body+first*sealedSize, (last-first+1)*sealedSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) == 0 {
+		return nil, errors.Wrapf(ErrCorruptObject, "range is out of object. key = %s", key)
+	}
+	body, final, err := s.cipher.openSegments(layout.header, key, layout.nonce, int(first), sealed, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key = %s", key)
+	}
+	// Short read must end with the final segment, or the object is truncated.
+	if int64(len(sealed)) < (last-first+1)*sealedSize && !final {
+		return nil, errors.Wrapf(ErrCorruptObject, "key = %s", key)
+	}
+	return sliceRange(body, offset-first*segmentSize, length), nil
+}
+
+func sliceRange(data []byte, offset, length int64) []byte {
+	if offset >= int64(len(data)) {
+		return []byte{}
+	}
+	end := offset + length
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[offset:end]
+}
@@ -0,0 +1,79 @@
+package bucketsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDownloadRangeSegmented(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.Compression = false
+
+	data := make([]byte, 3*segmentSize+123)
+	rand.New(rand.NewSource(2)).Read(data)
+	key := ObjectKey("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	fs := mountTestFS(t, config)
+	err := fs.Sess.storage.Upload(key, bytes.NewReader(data), kindExtent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Close()
+
+	// Fresh session has nothing in memory
+	fs = mountTestFS(t, config)
+	sess := fs.Sess
+	ranges := [][2]int64{
+		{0, 10},
+		{100, segmentSize},
+		{segmentSize - 5, 10},            // across segments
+		{2*segmentSize + 7, segmentSize}, // into the final segment
+		{int64(len(data)) - 3, 100},      // beyond the end
+		{int64(len(data)) + 10, 10},
+	}
+	for _, r := range ranges {
+		got, err := sess.storage.DownloadRange(key, r[0], r[1])
+		if err != nil {
+			t.Fatalf("range %v: %v", r, err)
+		}
+		if want := sliceRange(data, r[0], r[1]); !bytes.Equal(got, want) {
+			t.Fatalf("range %v: got %d bytes, want %d bytes", r, len(got), len(want))
+		}
+	}
+	if layout, _ := sess.storage.layout(key); layout.cipher != cipherAESGCMSegmented {
+		t.Fatalf("cipher is %d, want segmented", layout.cipher)
+	}
+	if stats := sess.storage.CacheStats(); stats.Bytes >= int64(len(data)) {
+		t.Fatalf("whole object is downloaded, %d bytes are cached", stats.Bytes)
+	}
+
+	// Tampered segment is detected by range read
+	path := filepath.Join(config.LocalPath, key)
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedSize := segmentSize + sess.storage.cipher.aead.Overhead()
+	body := objectHeaderLen + sess.storage.cipher.aead.NonceSize()
+	raw[body+sealedSize+10] ^= 1
+	err = ioutil.WriteFile(path, raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	sess = fs.Sess
+	if _, err := sess.storage.DownloadRange(key, 0, 10); err != nil {
+		t.Fatalf("untouched segment: %v", err)
+	}
+	if _, err := sess.storage.DownloadRange(key, segmentSize+5, 10); errors.Cause(err) != ErrCorruptObject {
+		t.Fatalf("tampered segment: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package bucketsync
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// readahead prefetches extents for sequential readers into the cache.
+// Total size of extents being prefetched is limited by budget.
+type readahead struct {
+	lock     sync.Mutex
+	budget   int64
+	inflight int64
+}
+
+func newReadahead(config *Config) *readahead {
+	if config.ReadaheadSize <= 0 {
+		return nil
+	}
+	return &readahead{
+		budget: int64(config.ReadaheadSize) << 20,
+	}
+}
+
+func (r *readahead) acquire(size int64) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.inflight+size > r.budget {
+		return false
+	}
+	r.inflight += size
+	return true
+}
+
+func (r *readahead) release(size int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.inflight -= size
+}
+
+// prefetch downloads extents in background, extents over budget are skipped.
+func (r *readahead) prefetch(sess *Session, extents []*Extent, size int64) {
+	for _, e := range extents {
+		if e.Size != 0 { // chunk
+			size = e.Size
+		}
+		if !r.acquire(size) {
+			return
+		}
+		go func(key ObjectKey, size int64) {
+			defer r.release(size)
+			_, err := sess.storage.DownloadWithCache(key, kindExtent)
+			if err != nil {
+				sess.logger.Debug("prefetch failed", zap.String("key", key), zap.Error(err))
+			}
+		}(e.Key, size)
+	}
+}
+
+// readahead detects sequential read of the handle, and prefetches extents
+// after the read. The window doubles on each sequential read.
+func (f *OpenedFile) readahead(off, size int64) {
+	ra := f.file.sess.readahead
+	if ra == nil {
+		return
+	}
+	f.raLock.Lock()
+	defer f.raLock.Unlock()
+	if off != f.nextRead {
+		f.nextRead = off + size
+		f.window = 0
+		f.prefetched = 0
+		return
+	}
+	f.nextRead = off + size
+
+	if f.window == 0 {
+		f.window = f.file.ExtentSize
+	} else if f.window < ra.budget {
+		f.window *= 2
+	}
+
+	start := off + size
+	if start < f.prefetched {
+		start = f.prefetched
+	}
+	end := off + size + f.window
+	if end > f.file.Meta.Size {
+		end = f.file.Meta.Size
+	}
+	if start >= end {
+		return
+	}
+	f.prefetched = end
+
+	f.file.sess.logger.Debug("readahead", zap.Int64("start", start), zap.Int64("end", end))
+	ra.prefetch(f.file.sess, f.file.unfilledExtents(start, end), f.file.ExtentSize)
+}
+
+// unfilledExtents returns extents in [start, end), which are not in memory.
+func (o *File) unfilledExtents(start, end int64) []*Extent {
+	extents := make([]*Extent, 0)
+	unfilled := func(e *Extent) bool {
+		return !e.dirty && len(e.body) == 0 && e.Key != ""
+	}
+	if o.Chunking == ChunkingCDC {
+		for i := o.chunkIndex(start); i < len(o.Chunks) && o.Chunks[i].Offset < end; i++ {
+			if unfilled(o.Chunks[i]) {
+				extents = append(extents, o.Chunks[i])
+			}
+		}
+		return extents
+	}
+	for i := start / o.ExtentSize; i*o.ExtentSize < end; i++ {
+		if e, ok := o.Extent[i]; ok && unfilled(e) {
+			extents = append(extents, e)
+		}
+	}
+	return extents
+}
@@ -0,0 +1,85 @@
+package bucketsync
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestReadaheadWindow(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.ReadaheadSize = 1
+
+	fs := mountTestFS(t, config)
+	size := config.ExtentSize
+	data := make([]byte, 8*size)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeTestFile(t, fs, "file", data)
+	fs.Close()
+
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	opened, status := fs.Open("file", uint32(os.O_RDONLY), testContext)
+	if status != fuse.OK {
+		t.Fatal(status)
+	}
+	defer opened.Release()
+	f := opened.(*OpenedFile)
+	read := func(off int64) {
+		if _, status := f.Read(make([]byte, size), off); status != fuse.OK {
+			t.Fatal(status)
+		}
+	}
+
+	// The window doubles, prefetched extents are not requested again
+	read(0)
+	if f.window != size || f.prefetched != 2*size {
+		t.Fatalf("window = %d, prefetched = %d", f.window, f.prefetched)
+	}
+	read(size)
+	if f.window != 2*size || f.prefetched != 4*size {
+		t.Fatalf("window = %d, prefetched = %d", f.window, f.prefetched)
+	}
+	ra := fs.Sess.readahead
+	for i := 0; ; i++ {
+		ra.lock.Lock()
+		inflight := ra.inflight
+		ra.lock.Unlock()
+		if inflight == 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("%d bytes are in flight", inflight)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := int64(2); i < 4; i++ {
+		if _, err := fs.Sess.storage.cache.Get(f.file.Extent[i].Key); err != nil {
+			t.Fatalf("extent %d is not prefetched", i)
+		}
+	}
+
+	// Random read resets the window
+	read(6 * size)
+	if f.window != 0 || f.prefetched != 0 {
+		t.Fatalf("window = %d after random read", f.window)
+	}
+}
+
+func TestReadaheadBudget(t *testing.T) {
+	ra := newReadahead(&Config{ReadaheadSize: 1})
+	if !ra.acquire(768<<10) || ra.acquire(512<<10) {
+		t.Fatal("budget is not enforced")
+	}
+	ra.release(768 << 10)
+	if !ra.acquire(512 << 10) {
+		t.Fatal("budget is not released")
+	}
+	if newReadahead(&Config{}) != nil {
+		t.Fatal("readahead is enabled without budget")
+	}
+}
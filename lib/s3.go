@@ -1,10 +1,16 @@
 package bucketsync
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -12,15 +18,26 @@ import (
 	"go.uber.org/zap"
 )
 
+// S3Session is ObjectStore driver for Amazon S3.
+// Failed requests are retried with jittered exponential backoff, and each
+// attempt is cancelled after timeout.
 type S3Session struct {
-	svc         *s3.S3
-	cache       *cache
-	logger      *Logger
-	cipher      *Cipher
-	compression bool
-	bucket      string
+	svc       *s3.S3
+	logger    *Logger
+	bucket    string
+	multipart multipartConfig
+	retries   int
+	timeout   time.Duration
 }
 
+// Defaults of retry and timeout
+const (
+	defaultRetries        = 5
+	defaultRequestTimeout = time.Minute
+	retryBackoffMin       = 200 * time.Millisecond
+	retryBackoffMax       = 10 * time.Second
+)
+
 func NewS3Session(config *Config, logger *Logger) (*S3Session, error) {
 	sess := session.Must(session.NewSession())
 
@@ -32,97 +49,264 @@ func NewS3Session(config *Config, logger *Logger) (*S3Session, error) {
 			"",
 		),
 		Logger: aws.Logger(logger),
+		// Requests are retried by S3Session
+		MaxRetries: aws.Int(0),
 		//LogLevel: aws.LogLevel(aws.LogDebugWithHTTPBody),
 	})
 
 	s3Session := &S3Session{svc: svc,
-		cache:       NewCache(10),
-		logger:      logger,
-		bucket:      config.Bucket,
-		compression: config.Compression,
+		logger:    logger,
+		bucket:    config.Bucket,
+		multipart: newMultipartConfig(config),
+		retries:   config.Retries,
+		timeout:   time.Duration(config.RequestTimeout) * time.Second,
 	}
-
-	if config.Encryption {
-		var err error
-		s3Session.cipher, err = NewCipher(config.Password)
-		if err != nil {
-			return nil, err
-		}
+	if s3Session.retries == 0 {
+		s3Session.retries = defaultRetries
+	} else if s3Session.retries < 0 {
+		s3Session.retries = 0
+	}
+	if s3Session.timeout <= 0 {
+		s3Session.timeout = defaultRequestTimeout
 	}
 
 	return s3Session, nil
 }
 
-func (s *S3Session) DownloadWithCache(key ObjectKey) ([]byte, error) {
-	cached, err := s.cache.Get(key)
-	if err == nil {
-		return cached, nil
-	}
-	new, err := s.Download(key)
+func (s *S3Session) Download(key ObjectKey) ([]byte, error) {
+	s.logger.Debug("Download", zap.String("key", key))
+
+	var body []byte
+	err := s.do("GetObject", key, func(ctx aws.Context) error {
+		paramsGet := &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}
+		obj, cause := s.svc.GetObjectWithContext(ctx, paramsGet)
+		if cause != nil {
+			return cause
+		}
+		defer obj.Body.Close()
+
+		body, cause = ioutil.ReadAll(obj.Body)
+		return cause
+	})
 	if err != nil {
 		return nil, err
 	}
-	s.cache.Add(key, new)
-	return new, nil
+
+	s.logger.Debug("Download", zap.Int("size", len(body)))
+	return body, nil
 }
 
-func (s *S3Session) Download(key ObjectKey) ([]byte, error) {
-	s.logger.Debug("Download", zap.String("key", key))
+func (s *S3Session) DownloadRange(key ObjectKey, offset, length int64) ([]byte, error) {
+	s.logger.Debug("DownloadRange", zap.String("key", key), zap.Int64("offset", offset), zap.Int64("length", length))
 
-	if key == "" {
-		return nil, errors.New("Key shouldn't be empty")
-	}
+	var body []byte
+	err := s.do("GetObject", key, func(ctx aws.Context) error {
+		paramsGet := &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		}
+		obj, cause := s.svc.GetObjectWithContext(ctx, paramsGet)
+		if statusCode(cause) == http.StatusRequestedRangeNotSatisfiable {
+			// Range starts after the end of object
+			body = []byte{}
+			return nil
+		}
+		if cause != nil {
+			return cause
+		}
+		defer obj.Body.Close()
 
-	paramsGet := &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		body, cause = ioutil.ReadAll(obj.Body)
+		return cause
+	})
+	if err != nil {
+		return nil, err
 	}
-	obj, cause := s.svc.GetObject(paramsGet)
+
+	s.logger.Debug("DownloadRange", zap.Int("size", len(body)))
+	return body, nil
+}
+
+func (s *S3Session) Upload(key ObjectKey, value io.ReadSeeker) error {
+	s.logger.Debug("Upload", zap.String("key", key))
+
+	size, cause := value.Seek(0, io.SeekEnd)
 	if cause != nil {
-		return nil, errors.Wrapf(cause, "GetObject failed. key = %s", key)
+		return errors.Wrapf(cause, "Seek failed. key = %s", key)
+	}
+	value.Seek(0, io.SeekStart)
+	if size > s.multipart.threshold {
+		return s.uploadMultipart(key, value)
 	}
-	defer obj.Body.Close()
 
-	body, cause := ioutil.ReadAll(obj.Body)
-	if cause != nil {
-		return nil, errors.Wrapf(cause, "GetObject failed. key = %s", key)
+	return s.do("PutObject", key, func(ctx aws.Context) error {
+		_, cause := value.Seek(0, io.SeekStart)
+		if cause != nil {
+			return cause
+		}
+		paramsPut := &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+			Body:   value,
+		}
+		_, cause = s.svc.PutObjectWithContext(ctx, paramsPut)
+		return cause
+	})
+}
+
+func (s *S3Session) IsExist(key ObjectKey) (bool, error) {
+	err := s.do("HeadObject", key, func(ctx aws.Context) error {
+		paramsHead := &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}
+		_, cause := s.svc.HeadObjectWithContext(ctx, paramsHead)
+		return cause
+	})
+	if errors.Cause(err) == ErrNotFound {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	s.logger.Debug("Download", zap.Int("size", len(body)))
-	return body, nil
+// Touch copies the object to itself, S3 doesn't allow the copy unless
+// metadata is replaced.
+func (s *S3Session) Touch(key ObjectKey) (bool, error) {
+	s.logger.Debug("Touch", zap.String("key", key))
+
+	err := s.do("CopyObject", key, func(ctx aws.Context) error {
+		paramsCopy := &s3.CopyObjectInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(key),
+			CopySource:        aws.String(s.bucket + "/" + key),
+			MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		}
+		_, cause := s.svc.CopyObjectWithContext(ctx, paramsCopy)
+		return cause
+	})
+	if errors.Cause(err) == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-func (s *S3Session) UploadWithCache(key ObjectKey, value io.ReadSeeker) error {
-	data, err := ioutil.ReadAll(value)
-	if err != nil {
-		return err
+func (s *S3Session) Delete(key ObjectKey) error {
+	s.logger.Debug("Delete", zap.String("key", key))
+
+	return s.do("DeleteObject", key, func(ctx aws.Context) error {
+		paramsDelete := &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}
+		_, cause := s.svc.DeleteObjectWithContext(ctx, paramsDelete)
+		return cause
+	})
+}
+
+// List requests pages one by one, a failed page is retried.
+func (s *S3Session) List(fn func(info ObjectInfo) error) error {
+	var token *string
+	for {
+		var page *s3.ListObjectsV2Output
+		err := s.do("ListObjectsV2", "", func(ctx aws.Context) error {
+			paramsList := &s3.ListObjectsV2Input{
+				Bucket:            aws.String(s.bucket),
+				ContinuationToken: token,
+			}
+			var cause error
+			page, cause = s.svc.ListObjectsV2WithContext(ctx, paramsList)
+			return cause
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range page.Contents {
+			err = fn(ObjectInfo{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if !aws.BoolValue(page.IsTruncated) {
+			return nil
+		}
+		token = page.NextContinuationToken
 	}
-	s.cache.Add(key, data)
-	value.Seek(0, 0)
+}
+
+// do calls fn with timeout, and retries it if the error is transient.
+// The returned error is ErrNotFound if the object doesn't exist.
+func (s *S3Session) do(op string, key ObjectKey, fn func(ctx aws.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		cause := fn(ctx)
+		cancel()
+		if cause == nil {
+			return nil
+		}
+		if isNotFound(cause) {
+			return errors.Wrapf(ErrNotFound, "%s failed. key = %s", op, key)
+		}
+		if attempt >= s.retries || !isRetryable(cause) {
+			return errors.Wrapf(cause, "%s failed. key = %s", op, key)
+		}
 
-	return s.Upload(key, value)
+		delay := backoff(attempt)
+		s.logger.Warn("S3 request failed", zap.String("op", op), zap.String("key", key),
+			zap.Int("attempt", attempt+1), zap.Duration("retry after", delay), zap.Error(cause))
+		time.Sleep(delay)
+	}
 }
 
-func (s *S3Session) Upload(key ObjectKey, value io.ReadSeeker) error {
-	s.logger.Debug("Upload", zap.String("key", key))
+// backoff returns random delay up to exponential backoff of the attempt,
+// so that clients don't retry at the same time.
+func backoff(attempt int) time.Duration {
+	max := retryBackoffMin << uint(attempt)
+	if max > retryBackoffMax || max <= 0 {
+		max = retryBackoffMax
+	}
+	return retryBackoffMin/2 + time.Duration(rand.Int63n(int64(max)))
+}
 
-	paramsPut := &s3.PutObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
-		Body:   value,
+// statusCode returns HTTP status code of the S3 error, or 0
+func statusCode(err error) int {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode()
 	}
-	_, cause := s.svc.PutObject(paramsPut)
-	if cause != nil {
-		return errors.Wrapf(cause, "PutObject failed. key = %s", key)
+	return 0
+}
+
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		case s3.ErrCodeNoSuchBucket:
+			return false
+		}
 	}
-	return nil
+	return statusCode(err) == http.StatusNotFound
 }
 
-func (s *S3Session) IsExist(key ObjectKey) bool {
-	paramsHead := &s3.HeadObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+// isRetryable returns false if the request is rejected by S3,
+// server errors, throttling and network errors are retried.
+func isRetryable(err error) bool {
+	code := statusCode(err)
+	switch {
+	case code == 0:
+		return true
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true
+	case code >= 500:
+		return true
 	}
-	_, err := s.svc.HeadObject(paramsHead)
-	return err == nil
+	return false
 }
@@ -0,0 +1,75 @@
+package bucketsync
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+func requestFailure(code string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "")
+}
+
+func TestRetryClassification(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		status    int
+		notFound  bool
+		retryable bool
+	}{
+		{"network", errors.New("connection reset"), 0, false, true},
+		{"canceled", awserr.New("RequestCanceled", "timeout", nil), 0, false, true},
+		{"no such key", requestFailure(s3.ErrCodeNoSuchKey, 404), 404, true, false},
+		{"head not found", requestFailure("NotFound", 404), 404, true, false},
+		{"no such bucket", requestFailure(s3.ErrCodeNoSuchBucket, 404), 404, false, false},
+		{"no such upload", requestFailure(s3.ErrCodeNoSuchUpload, 404), 404, true, false},
+		{"access denied", requestFailure("AccessDenied", 403), 403, false, false},
+		{"bad request", requestFailure("InvalidArgument", 400), 400, false, false},
+		{"timeout", requestFailure("RequestTimeout", 408), 408, false, true},
+		{"throttled", requestFailure("SlowDown", 429), 429, false, true},
+		{"internal", requestFailure("InternalError", 500), 500, false, true},
+		{"unavailable", requestFailure("ServiceUnavailable", 503), 503, false, true},
+	}
+	for _, test := range tests {
+		if got := statusCode(test.err); got != test.status {
+			t.Errorf("%s: statusCode = %d", test.name, got)
+		}
+		if got := isNotFound(test.err); got != test.notFound {
+			t.Errorf("%s: isNotFound = %v", test.name, got)
+		}
+		if got := isRetryable(test.err); got != test.retryable {
+			t.Errorf("%s: isRetryable = %v", test.name, got)
+		}
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	if !isPermanent(requestFailure("AccessDenied", 403)) {
+		t.Error("rejected request is retried")
+	}
+	if !isPermanent(&os.PathError{Op: "open", Path: "staged", Err: os.ErrNotExist}) {
+		t.Error("lost staged file is retried")
+	}
+	if isPermanent(requestFailure("SlowDown", 503)) || isPermanent(errors.New("connection reset")) {
+		t.Error("transient error is not retried")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		max := retryBackoffMin << uint(attempt)
+		if max > retryBackoffMax || max <= 0 {
+			max = retryBackoffMax
+		}
+		for i := 0; i < 10; i++ {
+			delay := backoff(attempt)
+			if delay < retryBackoffMin/2 || delay >= retryBackoffMin/2+max {
+				t.Fatalf("attempt %d: delay = %v", attempt, delay)
+			}
+		}
+	}
+}
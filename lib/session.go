@@ -1,7 +1,9 @@
 package bucketsync
 
 import (
-	"fmt"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
 	"syscall"
 	"time"
@@ -12,22 +14,40 @@ import (
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/pkg/errors"
-	"github.com/spaolacci/murmur3"
 	"go.uber.org/zap"
 )
 
+var ErrInvalidMode = errors.New("node has invalid mode")
+
 type Session struct {
-	s3     *S3Session
-	config *Config
-	logger *Logger
+	storage   *Storage
+	config    *Config
+	logger    *Logger
+	rootKey   ObjectKey
+	hashKey   []byte     // secret for KeyGen, nil if encryption is disabled
+	journal   *journal   // nil if journal is disabled
+	readahead *readahead // nil if readahead is disabled
+	metaCache *metaCache // nil if timeouts are zero
+	handles   *openedFiles
+	usage     *superblock
 }
 
+// KeyGen returns content address of extent. It's SHA-256, keyed with
+// a secret if encryption is enabled, so the key doesn't leak the content.
+// Extents written by older versions are named by murmur3.
 func (s *Session) KeyGen(object []byte) ObjectKey {
-	return fmt.Sprintf("%x", murmur3.Sum64(object))
+	if s.hashKey != nil {
+		mac := hmac.New(sha256.New, s.hashKey)
+		mac.Write(object)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	sum := sha256.Sum256(object)
+	return hex.EncodeToString(sum[:])
 }
 
+// RootKey is recorded in BucketHeader
 func (s *Session) RootKey() ObjectKey {
-	return s.KeyGen([]byte(s.config.Password))
+	return s.rootKey
 }
 
 func NewSession(config *Config) (*Session, error) {
@@ -40,19 +60,47 @@ func NewSession(config *Config) (*Session, error) {
 		return nil, err
 	}
 
-	s3Session, err := NewS3Session(config, logger)
+	storage, err := NewStorage(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	rootKey, keys, err := storage.openBucket(config)
 	if err != nil {
+		storage.Close()
 		return nil, err
 	}
 
 	bsess := &Session{
-		s3:     s3Session,
-		config: config,
-		logger: logger,
+		storage:   storage,
+		config:    config,
+		logger:    logger,
+		rootKey:   rootKey,
+		readahead: newReadahead(config),
+		metaCache: newMetaCache(config),
+		handles:   newOpenedFiles(),
+	}
+	if keys != nil {
+		bsess.hashKey = keys.contentHash
 	}
 
-	if !bsess.s3.IsExist(bsess.RootKey()) {
-		logger.Error("root key is not found", zap.Error(err))
+	// Locked before anything is written, the journal directory is shared
+	// with a running mount.
+	bsess.journal, err = newJournal(config, storage.cipher, logger)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	// Root is created only if it's surely missing, a transient error
+	// must not replace the filesystem with an empty one.
+	rootExists, err := bsess.storage.IsExist(bsess.RootKey())
+	if err != nil {
+		bsess.Close()
+		return nil, errors.Wrap(err, "failed to check root directory")
+	}
+	if !rootExists {
+		logger.Error("root key is not found")
 
 		root := &Directory{
 			Key: bsess.RootKey(),
@@ -71,14 +119,46 @@ func NewSession(config *Config) (*Session, error) {
 
 		err := root.Save()
 		if err != nil {
+			bsess.Close()
 			return nil, err
 		}
+	} else {
+		// Detect encryption setting mismatch, before any object is written.
+		_, err := bsess.NewDirectory(bsess.RootKey())
+		if err != nil {
+			bsess.Close()
+			return nil, errors.Wrap(err, "failed to read root directory")
+		}
+	}
+
+	bsess.usage, err = loadSuperblock(bsess)
+	if err != nil {
+		bsess.Close()
+		return nil, err
+	}
+
+	err = bsess.replayJournal()
+	if err != nil {
+		bsess.Close()
+		return nil, err
 	}
 
 	logger.Debug("New session created", zap.String("Root UUID", bsess.RootKey()))
 	return bsess, nil
 }
 
+// Close waits for background uploads, and releases the local directories.
+// It's also called if NewSession failed.
+func (s *Session) Close() {
+	err := s.usage.close()
+	if err != nil {
+		s.logger.Error("Superblock save failed", zap.Error(err))
+	}
+	s.storage.Close()
+	s.journal.Close()
+	s.logger.Sync()
+}
+
 func (s *Session) CreateDirectory(key, parent ObjectKey, mode uint32, context *fuse.Context) *Directory {
 	return &Directory{
 		Key:      key,
@@ -89,7 +169,7 @@ func (s *Session) CreateDirectory(key, parent ObjectKey, mode uint32, context *f
 }
 
 func (s *Session) NewDirectory(key ObjectKey) (*Directory, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+	obj, err := s.storage.DownloadWithCache(key, kindMeta)
 	if err != nil {
 		return nil, err
 	}
@@ -108,12 +188,13 @@ func (s *Session) CreateFile(key, parent ObjectKey, mode uint32, context *fuse.C
 		Meta:       NewMeta(fuse.S_IFREG|mode, context),
 		ExtentSize: s.config.ExtentSize,
 		Extent:     make(map[int64]*Extent, 0),
+		Chunking:   s.config.Chunking,
 		sess:       s,
 	}
 }
 
 func (s *Session) NewFile(key ObjectKey) (*File, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+	obj, err := s.storage.DownloadWithCache(key, kindMeta)
 	if err != nil {
 		return nil, err
 	}
@@ -123,9 +204,13 @@ func (s *Session) NewFile(key ObjectKey) (*File, error) {
 		return nil, err
 	}
 	node.sess = s
+	node.savedSize = node.Meta.Size
 	for _, e := range node.Extent {
 		e.sess = s
 	}
+	for _, e := range node.Chunks {
+		e.sess = s
+	}
 
 	s.logger.Debug("NewFile", zap.String("key", key),
 		zap.Int("extent count", len(node.Extent)))
@@ -147,7 +232,7 @@ func (s *Session) CreateSymLink(key, parent ObjectKey, linkTo string, context *f
 }
 
 func (s *Session) NewSymLink(key ObjectKey) (*SymLink, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+	obj, err := s.storage.DownloadWithCache(key, kindMeta)
 	if err != nil {
 		return nil, err
 	}
@@ -161,7 +246,7 @@ func (s *Session) NewSymLink(key ObjectKey) (*SymLink, error) {
 }
 
 func (s *Session) NewNode(key ObjectKey) (*Node, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+	obj, err := s.storage.DownloadWithCache(key, kindMeta)
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +261,7 @@ func (s *Session) NewNode(key ObjectKey) (*Node, error) {
 
 // NewNode returns Directory, File or Symlink
 func (s *Session) NewTypedNode(key ObjectKey) (interface{}, error) {
-	obj, err := s.s3.DownloadWithCache(key)
+	obj, err := s.storage.DownloadWithCache(key, kindMeta)
 	if err != nil {
 		return nil, err
 	}
@@ -197,16 +282,20 @@ func (s *Session) NewTypedNode(key ObjectKey) (interface{}, error) {
 	case syscall.S_IFLNK:
 		node = &SymLink{sess: s}
 	default:
-		panic("Not implemented")
+		return nil, errors.Wrapf(ErrInvalidMode, "key = %s, mode = %o", key, tmpNode.Meta.Mode)
 	}
 	err = json.Unmarshal(obj, node)
 	if err != nil {
 		return nil, err
 	}
+	if file, ok := node.(*File); ok {
+		file.savedSize = file.Meta.Size
+	}
 
 	return node, nil
 }
 
+// PathWalk returns key of the path. Results are cached by metaCache.
 func (s *Session) PathWalk(relPath string) (key ObjectKey, err error) {
 	s.logger.Debug("PathWalk", zap.String("relPath", relPath))
 	key = s.RootKey()
@@ -217,29 +306,40 @@ func (s *Session) PathWalk(relPath string) (key ObjectKey, err error) {
 		return key, nil
 	}
 
-	node, err := s.NewDirectory(key)
-	if err != nil {
-		return "", err
-	}
-
 	// "a/b/c" => [0:a, 1:b, 2:c] , len = 3
 	pathList := strings.Split(relPath, string(filepath.Separator))
 	for i, p := range pathList {
-		var ok bool
-		if key, ok = node.FileMeta[p]; !ok {
-			return "", errors.New("File not found")
-		}
-
-		if i == len(pathList)-1 { // key points 2:c in example.
-			break
+		prefix := strings.Join(pathList[:i+1], string(filepath.Separator))
+		if cached, ok := s.metaCache.entry(prefix); ok {
+			key = cached
+			continue
 		}
 
-		node, err = s.NewDirectory(key)
+		// key is parent directory of p
+		node, err := s.NewDirectory(key)
 		if err != nil {
 			return "", err
 		}
+		var ok bool
+		if key, ok = node.FileMeta[p]; !ok {
+			return "", errors.Wrapf(ErrNotFound, "%s is not found", p)
+		}
+		s.metaCache.addEntry(prefix, key)
 	}
 
 	s.logger.Debug("PathWalk finished", zap.String("key", key))
 	return
 }
+
+// NodeMeta returns Meta of the node, it's cached by metaCache.
+func (s *Session) NodeMeta(key ObjectKey) (Meta, error) {
+	if meta, ok := s.metaCache.meta(key); ok {
+		return meta, nil
+	}
+	node, err := s.NewNode(key)
+	if err != nil {
+		return Meta{}, err
+	}
+	s.metaCache.addMeta(key, node.Meta)
+	return node.Meta, nil
+}
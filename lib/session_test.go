@@ -0,0 +1,104 @@
+package bucketsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// Tests run on LocalStore in a temporary directory, which is removed by
+// the returned function.
+func newTestConfig(t *testing.T) (*Config, func()) {
+	dir, err := ioutil.TempDir("", "bucketsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Backend:       BackendLocal,
+		LocalPath:     filepath.Join(dir, "store"),
+		Password:      "password",
+		Logging:       "development",
+		LogOutputPath: filepath.Join(dir, "log"),
+		CacheSize:     16,
+		ExtentSize:    4096,
+		Encryption:    true,
+		Compression:   true,
+	}
+	return config, func() { os.RemoveAll(dir) }
+}
+
+// mountTestFS opens a session of config, like a mount
+func mountTestFS(t *testing.T, config *Config) *FileSystem {
+	sess, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FileSystem{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		Sess:       sess,
+		logger:     sess.logger,
+	}
+}
+
+var testContext = &fuse.Context{
+	Owner: fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())},
+}
+
+func writeTestFile(t *testing.T, fs *FileSystem, name string, data []byte) {
+	file, status := fs.Create(name, uint32(os.O_WRONLY), 0644, testContext)
+	if status != fuse.OK {
+		t.Fatalf("Create %s: %v", name, status)
+	}
+	if _, status := file.Write(data, 0); status != fuse.OK {
+		t.Fatalf("Write %s: %v", name, status)
+	}
+	if status := file.Flush(); status != fuse.OK {
+		t.Fatalf("Flush %s: %v", name, status)
+	}
+	file.Release()
+}
+
+func readTestFile(t *testing.T, fs *FileSystem, name string) []byte {
+	attr, status := fs.GetAttr(name, testContext)
+	if status != fuse.OK {
+		t.Fatalf("GetAttr %s: %v", name, status)
+	}
+	file, status := fs.Open(name, uint32(os.O_RDONLY), testContext)
+	if status != fuse.OK {
+		t.Fatalf("Open %s: %v", name, status)
+	}
+	defer file.Release()
+	result, status := file.Read(make([]byte, attr.Size), 0)
+	if status != fuse.OK {
+		t.Fatalf("Read %s: %v", name, status)
+	}
+	data, _ := result.Bytes(nil)
+	if int64(len(data)) > int64(attr.Size) {
+		data = data[:attr.Size]
+	}
+	return data
+}
+
+func TestSessionRemount(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	fs := mountTestFS(t, config)
+	if status := fs.Mkdir("dir", 0755, testContext); status != fuse.OK {
+		t.Fatal(status)
+	}
+	data := bytes.Repeat([]byte("bucketsync"), 1000)
+	writeTestFile(t, fs, "dir/file", data)
+	fs.Close()
+
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	if got := readTestFile(t, fs, "dir/file"); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, want %d bytes", len(got), len(data))
+	}
+}
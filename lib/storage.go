@@ -0,0 +1,317 @@
+package bucketsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by ObjectStore if the object doesn't exist,
+// other errors may be transient.
+var ErrNotFound = errors.New("object not found")
+
+// objectKind is told by the caller of Storage, caches and write-back
+// handle extents differently from metadata.
+type objectKind int
+
+const (
+	kindMeta   objectKind = iota // rewritten in place, e.g. nodes
+	kindExtent                   // named by content, never changes
+)
+
+// ObjectStore is a backend driver that stores objects by key.
+type ObjectStore interface {
+	Download(key ObjectKey) ([]byte, error)
+	// DownloadRange returns length bytes from offset of the stored object,
+	// it is shorter if the object ends before that.
+	DownloadRange(key ObjectKey, offset, length int64) ([]byte, error)
+	Upload(key ObjectKey, value io.ReadSeeker) error
+	// IsExist returns error only if it can't tell whether the object exists
+	IsExist(key ObjectKey) (bool, error)
+	Delete(key ObjectKey) error
+	// List calls fn for every object in the store
+	List(fn func(info ObjectInfo) error) error
+}
+
+// toucher is implemented by drivers which can update modification time of
+// the object without uploading it again. Touch returns false if the object
+// doesn't exist.
+type toucher interface {
+	Touch(key ObjectKey) (bool, error)
+}
+
+// staleUploadAborter is implemented by drivers which can leave incomplete
+// uploads in the backend.
+type staleUploadAborter interface {
+	AbortStaleUploads(threshold time.Time) (int, error)
+}
+
+// ObjectInfo is stored object's attributes
+type ObjectInfo struct {
+	Key          ObjectKey
+	Size         int64
+	LastModified time.Time
+}
+
+// NewObjectStore returns the driver selected by config.Backend
+func NewObjectStore(config *Config, logger *Logger) (ObjectStore, error) {
+	switch config.Backend {
+	case "", BackendS3:
+		return NewS3Session(config, logger)
+	case BackendLocal:
+		return NewLocalStore(config, logger)
+	default:
+		return nil, errors.Errorf("unknown backend %q", config.Backend)
+	}
+}
+
+// Storage is a driver independent layer on ObjectStore,
+// it holds cache and object encoding settings.
+// cipher is set by openBucket.
+type Storage struct {
+	backend   ObjectStore
+	cache     *cache
+	diskCache *DiskCache // nil if disk cache is disabled
+	logger    *Logger
+	cipher    *Cipher
+	codec     Codec      // nil if compression is disabled
+	writeBack *writeBack // nil if write-back is disabled
+	packs     *packStore // nil if packing is disabled
+
+	inflightLock sync.Mutex
+	inflight     map[ObjectKey]*download
+
+	layoutLock sync.Mutex
+	layouts    map[ObjectKey]*objectLayout
+
+	metaTimeout time.Duration // cached metadata is downloaded again after it
+}
+
+// download is in-flight DownloadWithCache,
+// concurrent calls for the same key share the result.
+type download struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func NewStorage(config *Config, logger *Logger) (*Storage, error) {
+	backend, err := NewObjectStore(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	var packs *packStore
+	if config.Packing {
+		packs, err = newPackStore(backend, logger)
+		if err != nil {
+			return nil, err
+		}
+		backend = packs
+	}
+	var diskCache *DiskCache
+	if config.DiskCacheDir != "" {
+		diskCache, err = NewDiskCache(config, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	storage := &Storage{
+		backend:   backend,
+		packs:     packs,
+		cache:     NewCache(int64(config.CacheSize) << 20),
+		diskCache: diskCache,
+		logger:    logger,
+		inflight:  make(map[ObjectKey]*download),
+		layouts:   make(map[ObjectKey]*objectLayout),
+
+		metaTimeout: metaTimeout(config),
+	}
+
+	if config.Compression {
+		storage.codec, err = NewCodec(config.CompressionCodec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.WriteBack {
+		storage.writeBack, err = newWriteBack(backend, config, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return storage, nil
+}
+
+func (s *Storage) DownloadWithCache(key ObjectKey, kind objectKind) ([]byte, error) {
+	var cached []byte
+	var err error
+	if kind == kindMeta {
+		// Another client may have changed it
+		cached, err = s.cache.GetFresh(key, s.metaTimeout)
+	} else {
+		cached, err = s.cache.Get(key)
+	}
+	if err == nil {
+		return cached, nil
+	}
+
+	s.inflightLock.Lock()
+	if d, ok := s.inflight[key]; ok {
+		s.inflightLock.Unlock()
+		<-d.done
+		return d.data, d.err
+	}
+	d := &download{done: make(chan struct{})}
+	s.inflight[key] = d
+	s.inflightLock.Unlock()
+
+	d.data, d.err = s.Download(key, kind)
+	if d.err == nil {
+		s.cache.Add(key, d.data)
+	}
+
+	s.inflightLock.Lock()
+	delete(s.inflight, key)
+	s.inflightLock.Unlock()
+	close(d.done)
+	return d.data, d.err
+}
+
+// CacheStats returns counters of memory cache
+func (s *Storage) CacheStats() CacheStats {
+	return s.cache.Stats()
+}
+
+func (s *Storage) Download(key ObjectKey, kind objectKind) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("Key shouldn't be empty")
+	}
+	if s.writeBack != nil {
+		if data, ok := s.writeBack.Get(key); ok {
+			return s.decode(key, data)
+		}
+	}
+	if s.diskCache != nil {
+		if data, ok := s.diskCache.get(key, kind); ok {
+			return s.decode(key, data)
+		}
+	}
+	data, err := s.backend.Download(key)
+	if err != nil {
+		return nil, err
+	}
+	if s.diskCache != nil {
+		s.diskCache.add(key, kind, data)
+	}
+	return s.decode(key, data)
+}
+
+func (s *Storage) UploadWithCache(key ObjectKey, value io.ReadSeeker, kind objectKind) error {
+	data, err := ioutil.ReadAll(value)
+	if err != nil {
+		return err
+	}
+	s.cache.Add(key, data)
+	value.Seek(0, 0)
+
+	return s.Upload(key, value, kind)
+}
+
+func (s *Storage) Upload(key ObjectKey, value io.ReadSeeker, kind objectKind) error {
+	data, err := ioutil.ReadAll(value)
+	if err != nil {
+		return err
+	}
+	encoded, err := s.encode(key, data)
+	if err != nil {
+		return err
+	}
+	s.forgetLayout(key)
+	if s.diskCache != nil {
+		// Old value must not be read, even if Upload failed.
+		s.diskCache.remove(key, kind)
+	}
+	if s.writeBack != nil {
+		err = s.writeBack.Stage(key, encoded, kind)
+	} else {
+		err = s.backend.Upload(key, bytes.NewReader(encoded))
+	}
+	if err != nil {
+		return err
+	}
+	if s.diskCache != nil {
+		s.diskCache.add(key, kind, encoded)
+	}
+	return nil
+}
+
+func (s *Storage) IsExist(key ObjectKey) (bool, error) {
+	if s.writeBack != nil {
+		if _, ok := s.writeBack.Get(key); ok {
+			return true, nil
+		}
+	}
+	return s.backend.IsExist(key)
+}
+
+// Touch updates modification time of the stored object, gc running now
+// keeps it for the grace period. It returns false if the object should be
+// uploaded, it doesn't exist or it can't be touched.
+func (s *Storage) Touch(key ObjectKey) (bool, error) {
+	if s.writeBack != nil {
+		if _, ok := s.writeBack.Get(key); ok {
+			return true, nil
+		}
+	}
+	t, ok := s.backend.(toucher)
+	if !ok {
+		return false, nil
+	}
+	return t.Touch(key)
+}
+
+// Sync waits until the object is uploaded in write-back mode
+func (s *Storage) Sync(key ObjectKey) error {
+	if s.writeBack != nil {
+		return s.writeBack.Sync(key)
+	}
+	return nil
+}
+
+// Close waits until all staged objects are uploaded
+func (s *Storage) Close() {
+	if s.writeBack != nil {
+		s.writeBack.Close()
+	}
+}
+
+// Delete removes the object of any kind, gc doesn't know it.
+func (s *Storage) Delete(key ObjectKey) error {
+	s.cache.Remove(key)
+	s.forgetLayout(key)
+	if s.diskCache != nil {
+		s.diskCache.remove(key, kindMeta)
+		s.diskCache.remove(key, kindExtent)
+	}
+	return s.backend.Delete(key)
+}
+
+// AbortStaleUploads aborts incomplete uploads initiated before threshold
+func (s *Storage) AbortStaleUploads(threshold time.Time) (int, error) {
+	aborter, ok := s.backend.(staleUploadAborter)
+	if !ok {
+		return 0, nil
+	}
+	return aborter.AbortStaleUploads(threshold)
+}
+
+func (s *Storage) List(fn func(info ObjectInfo) error) error {
+	return s.backend.List(fn)
+}
@@ -0,0 +1,232 @@
+package bucketsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// superblock keeps usage counters of the filesystem, which are reported by
+// StatFs and checked against the quota. Counters are updated in memory,
+// and saved every superblockFlushInterval and on Close. If the previous
+// session didn't close, they are counted again on mount. They drift if
+// another client writes to the bucket, fsck --repair counts them again.
+const superblockKey = "bucketsync-superblock"
+
+const superblockFlushInterval = 5 * time.Second
+
+var ErrNoSpace = errors.New("quota exceeded")
+
+type superblock struct {
+	sess        *Session
+	lock        sync.Mutex
+	bytes       int64 // total size of files
+	inodes      int64 // number of nodes, including the root
+	reserved    int64 // growth of files which are not saved yet
+	quotaBytes  int64 // 0 is unlimited
+	quotaInodes int64
+	dirty       bool
+	done        chan struct{}
+	closed      chan struct{}
+}
+
+// superblockObject is stored in superblockKey
+type superblockObject struct {
+	Bytes  int64 `json:"bytes"`
+	Inodes int64 `json:"inodes"`
+	Clean  bool  `json:"clean"` // saved by close
+}
+
+// loadSuperblock reads the superblock, or counts usage by walking the
+// tree if the bucket is written by older versions or not closed.
+func loadSuperblock(s *Session) (*superblock, error) {
+	b := &superblock{
+		sess:        s,
+		quotaBytes:  s.config.QuotaSize << 20,
+		quotaInodes: s.config.QuotaInodes,
+		done:        make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+
+	obj := &superblockObject{}
+	data, err := s.storage.DownloadWithCache(superblockKey, kindMeta)
+	if err == nil {
+		err = json.Unmarshal(data, obj)
+		if err != nil {
+			return nil, errors.Wrapf(ErrCorruptObject, "key = %s, %s", superblockKey, err)
+		}
+	} else if errors.Cause(err) != ErrNotFound {
+		return nil, err
+	}
+
+	if obj.Clean {
+		b.bytes, b.inodes = obj.Bytes, obj.Inodes
+	} else {
+		s.logger.Info("superblock is not clean, count usage")
+		b.bytes, b.inodes = s.countUsage()
+	}
+	// Mark as mounted
+	b.dirty = true
+	err = b.save(false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to save superblock")
+	}
+
+	go b.flusher()
+	return b, nil
+}
+
+// countUsage walks the tree, a node with hard links is counted once and
+// unreadable nodes are skipped.
+func (s *Session) countUsage() (bytes, inodes int64) {
+	visited := make(map[ObjectKey]bool)
+	queue := []ObjectKey{s.RootKey()}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		if visited[key] {
+			continue
+		}
+		visited[key] = true
+
+		node, err := s.NewTypedNode(key)
+		if err != nil {
+			// fsck reports it, usage is not a reason to refuse mounting
+			s.logger.Warn("Node is unreadable, not counted", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		inodes++
+		switch typed := node.(type) {
+		case *Directory:
+			for _, child := range typed.FileMeta {
+				queue = append(queue, child)
+			}
+		case *File:
+			bytes += typed.Meta.Size
+		}
+	}
+	return bytes, inodes
+}
+
+// add changes counters, nil superblock does nothing.
+func (b *superblock) add(bytes, inodes int64) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.bytes += bytes
+	b.inodes += inodes
+	b.dirty = true
+}
+
+// set replaces counters, after they are counted again
+func (b *superblock) set(bytes, inodes int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.bytes, b.inodes = bytes, inodes
+	b.dirty = true
+}
+
+func (b *superblock) usage() (bytes, inodes int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bytes, b.inodes
+}
+
+// reserveBytes reserves n bytes of growth, or returns ErrNoSpace if
+// files can't grow. Reservation is released by releaseBytes when the file
+// is saved, and counters are changed.
+func (b *superblock) reserveBytes(n int64) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.quotaBytes > 0 && b.bytes+b.reserved+n > b.quotaBytes {
+		return errors.Wrapf(ErrNoSpace, "used = %d, reserved = %d, growth = %d, quota = %d",
+			b.bytes, b.reserved, n, b.quotaBytes)
+	}
+	b.reserved += n
+	return nil
+}
+
+func (b *superblock) releaseBytes(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.reserved -= n
+}
+
+// reserveInode counts a new node, or returns ErrNoSpace if it can't be
+// created. Call add(0, -1) if the node is not saved.
+func (b *superblock) reserveInode() error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.quotaInodes > 0 && b.inodes >= b.quotaInodes {
+		return errors.Wrapf(ErrNoSpace, "inodes = %d, quota = %d", b.inodes, b.quotaInodes)
+	}
+	b.inodes++
+	b.dirty = true
+	return nil
+}
+
+// save uploads counters if they are changed, clean is true on close.
+func (b *superblock) save(clean bool) error {
+	b.lock.Lock()
+	if !b.dirty && !clean {
+		b.lock.Unlock()
+		return nil
+	}
+	obj := superblockObject{Bytes: b.bytes, Inodes: b.inodes, Clean: clean}
+	b.dirty = false
+	b.lock.Unlock()
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	err = b.sess.storage.UploadWithCache(superblockKey, bytes.NewReader(data), kindMeta)
+	if err != nil {
+		b.lock.Lock()
+		b.dirty = true
+		b.lock.Unlock()
+	}
+	return err
+}
+
+func (b *superblock) flusher() {
+	defer close(b.closed)
+	ticker := time.NewTicker(superblockFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+		err := b.save(false)
+		if err != nil {
+			b.sess.logger.Warn("Superblock save failed", zap.Error(err))
+		}
+	}
+}
+
+// close stops the flusher, and saves counters
+func (b *superblock) close() error {
+	if b == nil {
+		return nil
+	}
+	close(b.done)
+	<-b.closed
+	return b.save(true)
+}
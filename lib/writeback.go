@@ -0,0 +1,521 @@
+package bucketsync
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// writeBack stages objects in a local directory, and background workers
+// upload them. Extents are uploaded concurrently. A metadata object is
+// uploaded after all objects staged before it, so metadata in the bucket
+// never refers to objects which are not uploaded yet, unless they failed.
+//
+// An upload is retried uploadRetries times, unless the error is permanent.
+// Failed object is kept staged, it's read locally and uploaded again by
+// the next mount. Newer versions of the key are not uploaded after the
+// failure, they would be overwritten by the older version on the next
+// mount. Failure of other keys doesn't stop the upload. Staged files of
+// older versions are removed when a newer version is uploaded, replay
+// uploads only the latest version of a key.
+//
+// In packing mode, a single worker uploads objects in staged order as
+// packs. A pack is flushed when it's larger than packSize, or no object is
+// staged for packFlushDelay. Extents larger than a quarter of packSize are
+// uploaded as they are, before the pack.
+type writeBack struct {
+	backend ObjectStore
+	dir     string
+	dirLock *os.File // the directory is used by a process
+	logger  *Logger
+	queue   chan *uploadJob
+	lock    sync.Mutex
+	seq     uint64
+	pending map[ObjectKey]*uploadJob   // the latest job of the key
+	running map[uint64]*uploadJob      // jobs not uploaded yet
+	failed  map[ObjectKey][]*uploadJob // failed jobs, which are kept staged
+	wg      sync.WaitGroup
+
+	packer    packUploader // nil if packing is disabled
+	packSize  int64
+	packQueue []*uploadJob
+	packed    chan struct{} // notifies packQueue is added
+	flush     chan struct{} // requests to upload the pack now
+}
+
+type uploadJob struct {
+	seq  uint64
+	key  ObjectKey
+	kind objectKind
+	path string
+	size int64
+	deps []*uploadJob
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+// Backoff of failed upload
+const (
+	uploadRetries  = 8
+	uploadRetryMin = time.Second
+	uploadRetryMax = time.Minute
+)
+
+var errDependency = errors.New("older version is not uploaded")
+
+// Staged file is named seq-key, and the suffix for extents
+const stagedExtentSuffix = ".extent"
+
+const packFlushDelay = time.Second
+
+func newWriteBack(backend ObjectStore, config *Config, logger *Logger) (*writeBack, error) {
+	err := os.MkdirAll(config.WriteBackDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	// Objects staged by a running mount must not be replayed
+	dirLock, err := lockDir(config.WriteBackDir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &writeBack{
+		backend: backend,
+		dir:     config.WriteBackDir,
+		dirLock: dirLock,
+		logger:  logger,
+		queue:   make(chan *uploadJob),
+		pending: make(map[ObjectKey]*uploadJob),
+		running: make(map[uint64]*uploadJob),
+		failed:  make(map[ObjectKey][]*uploadJob),
+	}
+
+	if config.Packing {
+		packer, ok := backend.(packUploader)
+		if !ok {
+			dirLock.Close()
+			return nil, errors.New("backend doesn't support packing")
+		}
+		w.packer = packer
+		w.packSize = int64(config.PackSize) << 20
+		if w.packSize <= 0 {
+			w.packSize = 16 << 20
+		}
+		w.packed = make(chan struct{}, 1)
+		w.flush = make(chan struct{}, 1)
+		go w.packWorker()
+	} else {
+		concurrency := config.UploadConcurrency
+		if concurrency <= 0 {
+			concurrency = 1
+		}
+		for i := 0; i < concurrency; i++ {
+			go w.worker()
+		}
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err = w.replay()
+	if err != nil {
+		dirLock.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Stage writes data to local disk, and queues the upload.
+// Staged data is synced, it's uploaded on the next mount if the process died.
+func (w *writeBack) Stage(key ObjectKey, data []byte, kind objectKind) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.seq++
+	name := fmt.Sprintf("%016x-%s", w.seq, filepath.Base(key))
+	if kind == kindExtent {
+		name += stagedExtentSuffix
+	}
+	path := filepath.Join(w.dir, name)
+	err := writeFileSync(path, data)
+	if err != nil {
+		return err
+	}
+	w.enqueue(w.seq, key, kind, path, int64(len(data)))
+	return nil
+}
+
+// replay queues objects staged by the previous mount in order. Only the
+// latest version of a key is uploaded, older ones are removed.
+func (w *writeBack) replay() error {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+
+	type staged struct {
+		seq  uint64
+		key  ObjectKey
+		kind objectKind
+		path string
+		size int64
+	}
+	objects := make([]*staged, 0, len(infos))
+	latest := make(map[ObjectKey]*staged)
+	for _, info := range infos { // sorted by name, it's seq
+		if info.Name() == dirLockName {
+			continue
+		}
+		var seq uint64
+		var key ObjectKey
+		path := filepath.Join(w.dir, info.Name())
+		_, err := fmt.Sscanf(info.Name(), "%016x-%s", &seq, &key)
+		if err != nil {
+			// Temporary file of writeFileSync
+			os.Remove(path)
+			continue
+		}
+		// Staged by older versions without the suffix, it's taken as
+		// metadata, which waits for all objects before it.
+		kind := kindMeta
+		if strings.HasSuffix(key, stagedExtentSuffix) {
+			key = strings.TrimSuffix(key, stagedExtentSuffix)
+			kind = kindExtent
+		}
+		o := &staged{seq: seq, key: key, kind: kind, path: path, size: info.Size()}
+		objects = append(objects, o)
+		latest[key] = o
+		if seq > w.seq {
+			w.seq = seq
+		}
+	}
+
+	for _, o := range objects {
+		if latest[o.key] != o {
+			os.Remove(o.path)
+			continue
+		}
+		w.logger.Info("Upload staged object of previous mount", zap.String("key", o.key))
+		w.enqueue(o.seq, o.key, o.kind, o.path, o.size)
+	}
+	return nil
+}
+
+// enqueue must be called with lock
+func (w *writeBack) enqueue(seq uint64, key ObjectKey, kind objectKind, path string, size int64) {
+	job := &uploadJob{
+		seq:  seq,
+		key:  key,
+		kind: kind,
+		path: path,
+		size: size,
+		done: make(chan struct{}),
+	}
+
+	if w.packer != nil {
+		// Packs are uploaded in order, no dependency is needed.
+		// uploadPack checks failure of older versions.
+		w.pending[key] = job
+		w.running[job.seq] = job
+		w.wg.Add(1)
+		w.packQueue = append(w.packQueue, job)
+		notify(w.packed)
+		return
+	}
+
+	// Extents are named by content, they don't depend on other objects.
+	if kind == kindMeta {
+		for _, dep := range w.running {
+			job.deps = append(job.deps, dep)
+		}
+	}
+	w.pending[key] = job
+	w.running[job.seq] = job
+	w.wg.Add(1)
+
+	go func() {
+		for _, dep := range job.deps {
+			<-dep.done
+		}
+		if err := w.olderFailure(job); err != nil {
+			w.finish(job, err)
+			return
+		}
+		w.queue <- job
+	}()
+}
+
+// writeFileSync writes file atomically and durably
+func writeFileSync(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Get returns staged data, if the object is not uploaded yet.
+func (w *writeBack) Get(key ObjectKey) ([]byte, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	job, ok := w.pending[key]
+	if !ok {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(job.path)
+	if err != nil {
+		w.logger.Error("staged object is lost", zap.String("key", key), zap.Error(err))
+		return nil, false
+	}
+	return data, true
+}
+
+// Sync waits until the object and all objects staged before it are
+// uploaded, and returns error if the object is not uploaded.
+func (w *writeBack) Sync(key ObjectKey) error {
+	w.lock.Lock()
+	job, ok := w.pending[key]
+	w.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	notify(w.flush)
+	<-job.done
+	return job.err
+}
+
+// Close waits until all staged objects are uploaded, and releases the
+// directory.
+func (w *writeBack) Close() {
+	notify(w.flush)
+	w.wg.Wait()
+	w.dirLock.Close()
+}
+
+// notify sends to c without blocking, c is buffered or nil
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (w *writeBack) worker() {
+	for job := range w.queue {
+		w.upload(job)
+	}
+}
+
+func (w *writeBack) upload(job *uploadJob) {
+	err := w.retry(job.key, func() error {
+		return w.uploadFile(job)
+	})
+	w.finish(job, err)
+}
+
+// retry calls fn until it succeeds, the error is permanent, or it fails
+// uploadRetries times.
+func (w *writeBack) retry(key ObjectKey, fn func() error) error {
+	delay := uploadRetryMin
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt >= uploadRetries || isPermanent(err) {
+			w.logger.Error("background upload failed", zap.String("key", key),
+				zap.Int("attempts", attempt), zap.Error(err))
+			return err
+		}
+		w.logger.Warn("background upload failed", zap.String("key", key),
+			zap.Duration("retry after", delay), zap.Error(err))
+		time.Sleep(delay)
+		delay *= 2
+		if delay > uploadRetryMax {
+			delay = uploadRetryMax
+		}
+	}
+}
+
+// isPermanent returns true if retry can't succeed: the staged file is lost,
+// or the request is rejected by the backend.
+func isPermanent(err error) bool {
+	cause := errors.Cause(err)
+	if os.IsNotExist(cause) {
+		return true
+	}
+	code := statusCode(cause)
+	return code != 0 && !isRetryable(cause)
+}
+
+// olderFailure returns errDependency if an older version of the key
+// failed, uploading the job would be overwritten by the next mount.
+func (w *writeBack) olderFailure(job *uploadJob) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, failed := range w.failed[job.key] {
+		if failed.seq < job.seq {
+			return errors.Wrapf(errDependency, "key = %s, %s", job.key, failed.err)
+		}
+	}
+	return nil
+}
+
+// finish removes the job. Failed object is kept staged, unless the staged
+// file is lost. Uploaded object replaces failed older versions.
+func (w *writeBack) finish(job *uploadJob, err error) {
+	w.lock.Lock()
+	delete(w.running, job.seq)
+	job.err = err
+	if err == nil || os.IsNotExist(errors.Cause(err)) {
+		if w.pending[job.key] == job {
+			delete(w.pending, job.key)
+		}
+		os.Remove(job.path)
+	} else {
+		w.failed[job.key] = append(w.failed[job.key], job)
+	}
+	if err == nil {
+		newer := make([]*uploadJob, 0)
+		for _, failed := range w.failed[job.key] {
+			if failed.seq < job.seq {
+				os.Remove(failed.path)
+			} else {
+				newer = append(newer, failed)
+			}
+		}
+		if len(newer) > 0 {
+			w.failed[job.key] = newer
+		} else {
+			delete(w.failed, job.key)
+		}
+	}
+	w.lock.Unlock()
+
+	close(job.done)
+	w.wg.Done()
+}
+
+func (w *writeBack) uploadFile(job *uploadJob) error {
+	data, err := ioutil.ReadFile(job.path)
+	if err != nil {
+		return err
+	}
+	return w.backend.Upload(job.key, bytes.NewReader(data))
+}
+
+func (w *writeBack) packWorker() {
+	batch := make([]*uploadJob, 0)
+	var size int64
+	timer := time.NewTimer(packFlushDelay)
+	timer.Stop()
+	for {
+		force := false
+		select {
+		case <-w.packed:
+		case <-w.flush:
+			force = true
+		case <-timer.C:
+			force = true
+		}
+
+		w.lock.Lock()
+		jobs := w.packQueue
+		w.packQueue = nil
+		w.lock.Unlock()
+
+		for _, job := range jobs {
+			batch = append(batch, job)
+			size += job.size
+			if size >= w.packSize {
+				w.uploadPack(batch)
+				batch = make([]*uploadJob, 0)
+				size = 0
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if force {
+			w.uploadPack(batch)
+			batch = make([]*uploadJob, 0)
+			size = 0
+		} else if len(jobs) > 0 {
+			timer.Reset(packFlushDelay)
+		}
+	}
+}
+
+// uploadPack uploads jobs as a pack. Only the latest object of a key is
+// packed.
+func (w *writeBack) uploadPack(jobs []*uploadJob) {
+	latest := make(map[ObjectKey]*uploadJob)
+	for _, job := range jobs {
+		latest[job.key] = job
+	}
+
+	errs := make(map[*uploadJob]error)
+	entries := make([]packEntry, 0, len(jobs))
+	packed := make([]*uploadJob, 0, len(jobs))
+	for _, job := range jobs {
+		if latest[job.key] != job {
+			continue
+		}
+		if err := w.olderFailure(job); err != nil {
+			errs[job] = err
+			continue
+		}
+		var data []byte
+		err := w.retry(job.key, func() (err error) {
+			data, err = ioutil.ReadFile(job.path)
+			return err
+		})
+		if err == nil && job.kind == kindExtent && int64(len(data)) > w.packSize/4 {
+			err = w.retry(job.key, func() error {
+				return w.backend.Upload(job.key, bytes.NewReader(data))
+			})
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			errs[job] = err
+			continue
+		}
+		entries = append(entries, packEntry{key: job.key, kind: job.kind, data: data})
+		packed = append(packed, job)
+	}
+
+	if len(entries) > 0 {
+		err := w.retry(entries[0].key, func() error {
+			return w.packer.UploadPack(entries)
+		})
+		for _, job := range packed {
+			errs[job] = err
+		}
+	}
+	for _, job := range jobs {
+		w.finish(job, errs[job])
+	}
+}
@@ -0,0 +1,153 @@
+package bucketsync
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+// rejectStore rejects uploads of the keys, like a bucket policy does
+type rejectStore struct {
+	ObjectStore
+	lock     sync.Mutex
+	rejected map[ObjectKey]bool
+	uploads  map[ObjectKey]int
+}
+
+func (s *rejectStore) Upload(key ObjectKey, value io.ReadSeeker) error {
+	s.lock.Lock()
+	s.uploads[key]++
+	rejected := s.rejected[key]
+	s.lock.Unlock()
+	if rejected {
+		return awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
+	}
+	return s.ObjectStore.Upload(key, value)
+}
+
+func newTestWriteBack(t *testing.T) (*writeBack, *rejectStore, func()) {
+	config, cleanup := newTestConfig(t)
+	config.WriteBackDir = filepath.Join(filepath.Dir(config.LocalPath), "writeback")
+	config.UploadConcurrency = 2
+
+	logger, err := NewLogger(config.LogOutputPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := NewLocalStore(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &rejectStore{
+		ObjectStore: local,
+		rejected:    make(map[ObjectKey]bool),
+		uploads:     make(map[ObjectKey]int),
+	}
+	w, err := newWriteBack(store, config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, store, cleanup
+}
+
+func stagedFiles(t *testing.T, w *writeBack) int {
+	staged, err := filepath.Glob(filepath.Join(w.dir, "*-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(staged)
+}
+
+func TestWriteBackFailedVersion(t *testing.T) {
+	w, store, cleanup := newTestWriteBack(t)
+	defer cleanup()
+
+	store.rejected["meta"] = true
+	w.Stage("meta", []byte("first"), kindMeta)
+	if err := w.Sync("meta"); err == nil {
+		t.Fatal("rejected upload succeeded")
+	}
+
+	// Newer version is not uploaded, the next mount would overwrite it
+	store.rejected["meta"] = false
+	w.Stage("meta", []byte("second"), kindMeta)
+	if err := w.Sync("meta"); errors.Cause(err) != errDependency {
+		t.Fatalf("newer version: %v", err)
+	}
+	if store.uploads["meta"] != 1 {
+		t.Fatalf("uploaded %d times", store.uploads["meta"])
+	}
+	if data, ok := w.Get("meta"); !ok || string(data) != "second" {
+		t.Fatalf("staged %q", data)
+	}
+	w.Close()
+	if n := stagedFiles(t, w); n != 2 {
+		t.Fatalf("%d files are staged", n)
+	}
+
+	// Only the latest version is uploaded by the next mount
+	w, err := newWriteBack(store, &Config{WriteBackDir: w.dir, UploadConcurrency: 2}, w.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	data, err := store.Download("meta")
+	if err != nil || string(data) != "second" {
+		t.Fatalf("uploaded %q, %v", data, err)
+	}
+	if store.uploads["meta"] != 2 {
+		t.Fatalf("uploaded %d times", store.uploads["meta"])
+	}
+	if n := stagedFiles(t, w); n != 0 {
+		t.Fatalf("%d files are staged", n)
+	}
+}
+
+func TestWriteBackFailedOtherKey(t *testing.T) {
+	w, store, cleanup := newTestWriteBack(t)
+	defer cleanup()
+
+	store.rejected["extent"] = true
+	w.Stage("extent", []byte("data"), kindExtent)
+	w.Stage("meta", []byte("meta"), kindMeta)
+	w.Close()
+
+	if err := w.Sync("extent"); err == nil {
+		t.Fatal("rejected upload succeeded")
+	}
+	if err := w.Sync("meta"); err != nil {
+		t.Fatalf("failed by other key: %v", err)
+	}
+	if n := stagedFiles(t, w); n != 1 {
+		t.Fatalf("%d files are staged", n)
+	}
+}
+
+func TestWriteBackLocked(t *testing.T) {
+	w, store, cleanup := newTestWriteBack(t)
+	defer cleanup()
+
+	store.rejected["meta"] = true
+	w.Stage("meta", []byte("meta"), kindMeta)
+	w.Sync("meta")
+
+	// Staged objects of the running mount are not replayed
+	config := &Config{WriteBackDir: w.dir, UploadConcurrency: 2}
+	if _, err := newWriteBack(store, config, w.logger); errors.Cause(err) != ErrDirLocked {
+		t.Fatalf("second writeBack: %v", err)
+	}
+	if _, ok := w.Get("meta"); !ok || store.uploads["meta"] != 1 {
+		t.Fatalf("staged object is taken, uploaded %d times", store.uploads["meta"])
+	}
+
+	w.Close()
+	w, err := newWriteBack(store, config, w.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
@@ -0,0 +1,134 @@
+package bucketsync
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Extended attributes are stored in Meta of the node. A value larger than
+// xattrInlineSize is stored in a separate object named by its content,
+// like extents, so that large values don't slow down directory walks.
+
+// Limits of Linux
+const (
+	xattrNameMax = 255      // XATTR_NAME_MAX
+	xattrSizeMax = 64 << 10 // XATTR_SIZE_MAX
+)
+
+const xattrInlineSize = 4 << 10
+
+// Flags of setxattr(2)
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
+
+// XAttr is a value of extended attribute, Key is set if the value is
+// stored in a separate object.
+type XAttr struct {
+	Value []byte    `json:"value,omitempty"`
+	Key   ObjectKey `json:"key,omitempty"`
+}
+
+// xattrNamespaces are supported name prefixes, trusted.* is only for root.
+var xattrNamespaces = []string{"user.", "trusted.", "security."}
+
+// checkXAttrName returns fuse.OK if the caller can use the name
+func checkXAttrName(name string, context *fuse.Context) fuse.Status {
+	if len(name) > xattrNameMax {
+		return fuse.ERANGE
+	}
+	if name == aclAccessName || name == aclDefaultName {
+		return fuse.OK
+	}
+	for _, prefix := range xattrNamespaces {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			if prefix == "trusted." && context.Uid != 0 {
+				return fuse.EPERM
+			}
+			return fuse.OK
+		}
+	}
+	return fuse.Status(syscall.EOPNOTSUPP)
+}
+
+// newXAttr uploads the value if it's large
+func (s *Session) newXAttr(value []byte) (*XAttr, error) {
+	if len(value) <= xattrInlineSize {
+		return &XAttr{Value: value}, nil
+	}
+	key := s.KeyGen(value)
+	if touched, err := s.storage.Touch(key); err == nil && touched {
+		return &XAttr{Key: key}, nil
+	}
+	err := s.storage.UploadWithCache(key, bytes.NewReader(value), kindExtent)
+	if err != nil {
+		return nil, err
+	}
+	return &XAttr{Key: key}, nil
+}
+
+func (s *Session) xattrValue(x *XAttr) ([]byte, error) {
+	if x.Key == "" {
+		return x.Value, nil
+	}
+	return s.storage.DownloadWithCache(x.Key, kindExtent)
+}
+
+// checkXAttrFlags checks XATTR_CREATE and XATTR_REPLACE of flags
+func (m *Meta) checkXAttrFlags(name string, flags int) fuse.Status {
+	_, ok := m.XAttrs[name]
+	if ok && flags&xattrCreate != 0 {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if !ok && flags&xattrReplace != 0 {
+		return fuse.ENODATA
+	}
+	return fuse.OK
+}
+
+// setXAttr sets x as name, flags are XATTR_CREATE or XATTR_REPLACE
+func (m *Meta) setXAttr(name string, x *XAttr, flags int) fuse.Status {
+	if status := m.checkXAttrFlags(name, flags); status != fuse.OK {
+		return status
+	}
+	if m.XAttrs == nil {
+		m.XAttrs = make(map[string]*XAttr)
+	}
+	m.XAttrs[name] = x
+	return fuse.OK
+}
+
+func (m *Meta) removeXAttr(name string) fuse.Status {
+	if _, ok := m.XAttrs[name]; !ok {
+		return fuse.ENODATA
+	}
+	delete(m.XAttrs, name)
+	return fuse.OK
+}
+
+// addXAttrKeys adds keys of large values to keys
+func (m Meta) addXAttrKeys(keys map[ObjectKey]struct{}) {
+	for _, x := range m.XAttrs {
+		if x.Key != "" {
+			keys[x.Key] = struct{}{}
+		}
+	}
+}
+
+// xattrNames returns sorted names visible to the caller
+func (m Meta) xattrNames(context *fuse.Context) []string {
+	names := make([]string, 0, len(m.XAttrs))
+	for name := range m.XAttrs {
+		if checkXAttrName(name, context) != fuse.OK {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,80 @@
+package bucketsync
+
+import (
+	"bytes"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestXAttr(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	fs := mountTestFS(t, config)
+	writeTestFile(t, fs, "file", []byte("content"))
+	root := &fuse.Context{}
+	large := bytes.Repeat([]byte("x"), xattrInlineSize+1)
+
+	for name, value := range map[string][]byte{
+		"user.small":    []byte("small"),
+		"user.large":    large,
+		"trusted.value": []byte("trusted"),
+	} {
+		if status := fs.SetXAttr("file", name, value, 0, root); status != fuse.OK {
+			t.Fatalf("SetXAttr %s: %v", name, status)
+		}
+	}
+	if status := fs.SetXAttr("file", "user.small", nil, xattrCreate, root); status != fuse.Status(syscall.EEXIST) {
+		t.Fatalf("XATTR_CREATE of existing name: %v", status)
+	}
+	if status := fs.SetXAttr("file", "user.none", nil, xattrReplace, root); status != fuse.ENODATA {
+		t.Fatalf("XATTR_REPLACE of missing name: %v", status)
+	}
+	if status := fs.SetXAttr("file", "user.big", make([]byte, xattrSizeMax+1), 0, root); status != fuse.Status(syscall.E2BIG) {
+		t.Fatalf("too large value: %v", status)
+	}
+	if status := fs.SetXAttr("file", "other.name", nil, 0, root); status != fuse.Status(syscall.EOPNOTSUPP) {
+		t.Fatalf("unknown namespace: %v", status)
+	}
+	if status := fs.RemoveXAttr("file", "user.small", root); status != fuse.OK {
+		t.Fatal(status)
+	}
+	fs.Close()
+
+	// Large value is stored in another object, reachable from the node
+	fs = mountTestFS(t, config)
+	defer fs.Close()
+	if _, err := fs.Sess.GC(0, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, status := fs.GetXAttr("file", "user.large", root); status != fuse.OK || !bytes.Equal(data, large) {
+		t.Fatalf("large value is %d bytes, %v", len(data), status)
+	}
+	key, err := fs.Sess.PathWalk("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := fs.Sess.NodeMeta(key); err != nil || meta.XAttrs["user.large"].Key == "" {
+		t.Fatalf("large value is inline, %v", err)
+	}
+	if _, status := fs.GetXAttr("file", "user.small", root); status != fuse.ENODATA {
+		t.Fatalf("removed value: %v", status)
+	}
+
+	// trusted.* is only for root
+	user := &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}
+	names, status := fs.ListXAttr("file", root)
+	if status != fuse.OK || !reflect.DeepEqual(names, []string{"trusted.value", "user.large"}) {
+		t.Fatalf("names = %v, %v", names, status)
+	}
+	names, status = fs.ListXAttr("file", user)
+	if status != fuse.OK || !reflect.DeepEqual(names, []string{"user.large"}) {
+		t.Fatalf("names of user = %v, %v", names, status)
+	}
+	if _, status := fs.GetXAttr("file", "trusted.value", user); status != fuse.ENODATA {
+		t.Fatalf("trusted value of user: %v", status)
+	}
+}
@@ -13,8 +13,11 @@ import (
 	"path"
 
 	"strconv"
+	"time"
 
+	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
 	bucketsync "github.com/juntaki/bucketsync/lib"
 	"github.com/urfave/cli"
 	yaml "gopkg.in/yaml.v2"
@@ -66,11 +69,48 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:   "gc",
+			Usage:  "Delete unreferenced objects in the bucket, while no client is writing to it",
+			Action: gc,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "grace",
+					Value: 24 * time.Hour,
+					Usage: "objects newer than this are not deleted",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report reclaimable objects",
+				},
+			},
+		},
+		{
+			Name:   "fsck",
+			Usage:  "Check consistency of the filesystem",
+			Action: fsck,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "move broken entries into lost+found",
+				},
+			},
+		},
 		{
 			Name:   "config",
 			Usage:  "Unmount bucketsync filesystem",
 			Action: config,
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "backend",
+					Value: "",
+					Usage: "storage backend, s3 or local",
+				},
+				cli.StringFlag{
+					Name:  "localpath",
+					Value: "",
+					Usage: "directory path for local backend",
+				},
 				cli.StringFlag{
 					Name:  "bucket",
 					Value: "",
@@ -96,11 +136,47 @@ func main() {
 					Value: "",
 					Usage: "password for data encryption",
 				},
+				cli.StringFlag{
+					Name:  "keyfile",
+					Value: "",
+					Usage: "file which contains password for data encryption",
+				},
+				cli.StringFlag{
+					Name:  "compression",
+					Value: "",
+					Usage: "compression codec, gzip, zstd, lz4 or snappy",
+				},
+				cli.StringFlag{
+					Name:  "chunking",
+					Value: "",
+					Usage: "chunking mode of file content, fixed or cdc",
+				},
+				cli.StringFlag{
+					Name:  "diskcache",
+					Value: "",
+					Usage: "directory for persistent cache of downloaded objects",
+				},
+				cli.BoolFlag{
+					Name:  "writeback",
+					Usage: "upload in background, close() doesn't wait for upload",
+				},
+				cli.BoolFlag{
+					Name:  "packing",
+					Usage: "upload small objects together as a pack, implies --writeback",
+				},
 				cli.StringFlag{
 					Name:  "logging",
 					Value: "production",
 					Usage: "logging mode",
 				},
+				cli.Int64Flag{
+					Name:  "quota",
+					Usage: "maximum total size of files in MiB, 0 is unlimited",
+				},
+				cli.Int64Flag{
+					Name:  "quota-inodes",
+					Usage: "maximum number of files and directories, 0 is unlimited",
+				},
 			},
 		},
 	}
@@ -162,6 +238,12 @@ func config(cli *cli.Context) error {
 			Compression: true,
 		}
 	}
+	if cli.String("backend") != "" {
+		config.Backend = cli.String("backend")
+	}
+	if cli.String("localpath") != "" {
+		config.LocalPath = cli.String("localpath")
+	}
 	if cli.String("bucket") != "" {
 		config.Bucket = cli.String("bucket")
 	}
@@ -177,20 +259,93 @@ func config(cli *cli.Context) error {
 	if cli.String("password") != "" {
 		config.Password = cli.String("password") // TODO: hash
 	}
+	if cli.String("keyfile") != "" {
+		config.KeyFile = cli.String("keyfile")
+	}
+	if cli.String("compression") != "" {
+		config.CompressionCodec = cli.String("compression")
+	}
+	if cli.String("chunking") != "" {
+		config.Chunking = cli.String("chunking")
+	}
+	if cli.String("diskcache") != "" {
+		config.DiskCacheDir = cli.String("diskcache")
+	}
+	if cli.Bool("writeback") {
+		config.WriteBack = true
+	}
+	if cli.Bool("packing") {
+		config.WriteBack = true
+		config.Packing = true
+	}
 	if cli.String("logging") != "" {
 		config.Logging = cli.String("logging")
 	}
+	if cli.IsSet("quota") {
+		config.QuotaSize = cli.Int64("quota")
+	}
+	if cli.IsSet("quota-inodes") {
+		config.QuotaInodes = cli.Int64("quota-inodes")
+	}
 
 	// advance setting
+	if config.Backend == "" {
+		config.Backend = bucketsync.BackendS3
+	}
 	if config.LogOutputPath == "" {
 		config.LogOutputPath = configDir("bucketsync.log")
 	}
+	if config.CompressionCodec == "" {
+		config.CompressionCodec = bucketsync.CodecZstd
+	}
 	if config.CacheSize == 0 {
 		config.CacheSize = 1024
 	}
+	if config.DiskCacheSize == 0 {
+		config.DiskCacheSize = 1024 * 10
+	}
+	if config.WriteBackDir == "" {
+		config.WriteBackDir = configDir("staging")
+	}
+	if config.JournalDir == "" {
+		config.JournalDir = configDir("journal")
+	}
+	if config.ReadaheadSize == 0 {
+		config.ReadaheadSize = 32
+	}
+	if config.UploadConcurrency == 0 {
+		config.UploadConcurrency = 8
+	}
+	if config.EntryTimeout == 0 {
+		config.EntryTimeout = 1
+	}
+	if config.AttrTimeout == 0 {
+		config.AttrTimeout = 1
+	}
+	if config.Retries == 0 {
+		config.Retries = 5
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = 60
+	}
+	if config.PackSize == 0 {
+		config.PackSize = 16
+	}
+	if config.MultipartThreshold == 0 {
+		config.MultipartThreshold = 16
+	}
+	if config.MultipartPartSize == 0 {
+		config.MultipartPartSize = 8
+	}
+	if config.MultipartConcurrency == 0 {
+		config.MultipartConcurrency = 4
+	}
 	if config.ExtentSize == 0 {
 		config.ExtentSize = 1024 * 64
 	}
+	if config.Chunking == "" {
+		config.Chunking = bucketsync.ChunkingFixed
+	}
 
 	// TODO: check logging mode
 	configYAML, err := yaml.Marshal(config)
@@ -227,9 +382,16 @@ func mount(cli *cli.Context) error {
 	}
 
 	fs := bucketsync.NewFileSystem(config)
-	fs.SetDebug(true)
+	nodeFs := pathfs.NewPathNodeFs(fs, nil)
+	nodeFs.SetDebug(true)
 
-	s, _, err := nodefs.MountRoot(cli.String("dir"), fs.Root(), nil)
+	opts := &nodefs.Options{
+		EntryTimeout: time.Duration(config.EntryTimeout * float64(time.Second)),
+		AttrTimeout:  time.Duration(config.AttrTimeout * float64(time.Second)),
+	}
+	// Like nodefs.MountRoot, ftruncate is told to fs by the wrapper
+	conn := nodefs.NewFileSystemConnector(nodeFs.Root(), opts)
+	s, err := fuse.NewServer(bucketsync.NewRawFileSystem(conn.RawFS(), fs), cli.String("dir"), &fuse.MountOptions{})
 	if err != nil {
 		panic(err)
 	}
@@ -249,5 +411,66 @@ func mount(cli *cli.Context) error {
 	}()
 
 	s.Serve()
+	fs.Close()
 	return nil
 }
+
+func gc(cli *cli.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	sess, err := bucketsync.NewSession(config)
+	if err != nil {
+		return err
+	}
+
+	defer sess.Close()
+
+	if !cli.Bool("dry-run") {
+		log.Print("gc may delete blocks written during the run, make sure no client is writing to the bucket")
+	}
+	report, err := sess.GC(cli.Duration("grace"), cli.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("reachable objects:   %d\n", report.Reachable)
+	fmt.Printf("reclaimable objects: %d (%d bytes)\n", report.Garbage, report.Bytes)
+	fmt.Printf("within grace period: %d\n", report.Recent)
+	fmt.Printf("deleted objects:     %d\n", report.Deleted)
+	if report.Unknown > 0 {
+		fmt.Printf("unknown objects:     %d (kept)\n", report.Unknown)
+	}
+	fmt.Printf("aborted uploads:     %d\n", report.AbortedUploads)
+	if report.DeadPacks > 0 || report.Repacked > 0 {
+		fmt.Printf("dead packs:          %d\n", report.DeadPacks)
+		fmt.Printf("repacked packs:      %d\n", report.Repacked)
+	}
+	return nil
+}
+
+func fsck(cli *cli.Context) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	sess, err := bucketsync.NewSession(config)
+	if err != nil {
+		return err
+	}
+
+	defer sess.Close()
+
+	report, err := sess.Fsck(cli.Bool("repair"))
+	if report != nil {
+		for _, p := range report.Problems {
+			fmt.Printf("%s: %s (key = %s) %s\n", p.Kind, p.Path, p.Key, p.Detail)
+		}
+		fmt.Printf("checked nodes: %d, problems: %d, repaired: %d\n",
+			report.Checked, len(report.Problems), report.Repaired)
+	}
+	return err
+}